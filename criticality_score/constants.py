@@ -41,8 +41,81 @@ DEPENDENTS_COUNT_THRESHOLD = 500000
 # Others.
 TOP_CONTRIBUTOR_COUNT = 15
 ISSUE_LOOKBACK_DAYS = 90
+STALE_PR_DAYS = 90
+# Most recent commits checked for signatures, and fewest needed for a result.
+SIGNED_COMMIT_LOOKBACK_DAYS = 90
+SIGNED_COMMIT_SAMPLE_SIZE = 100
+SIGNED_COMMIT_MIN_COUNT = 10
+GOOD_FIRST_ISSUE_LABEL = 'good first issue'
+HELP_WANTED_LABEL = 'help wanted'
 RELEASE_LOOKBACK_DAYS = 365
 FAIL_RETRIES = 7
+PARAM_RETRIES = 3
+# GitHub asks clients to wait at least a minute after a secondary rate limit.
+SECONDARY_RATE_LIMIT_WAIT_SECONDS = 60
+# GitHub App installation tokens last an hour; mint a new one this early.
+GITHUB_APP_TOKEN_REFRESH_SECONDS = 300
+# Default number of decimal places in the criticality score.
+SCORE_PRECISION = 5
+# Average source line length used to estimate lines of code from bytes.
+BYTES_PER_LINE_ESTIMATE = 40
+GITHUB_WORKFLOWS_PATH = '.github/workflows'
+GITHUB_API_URL = 'https://api.github.com'
+GITHUB_GRAPHQL_URL = 'https://api.github.com/graphql'
+JSON_SCHEMA_URL = 'https://json-schema.org/draft/2020-12/schema'
+DEPS_DEV_API_URL = 'https://api.deps.dev/v3'
+# Reason recorded in --review-out for packages without a source repository.
+PACKAGE_NOT_RESOLVED_REASON = 'no source repository found on deps.dev'
+GITLAB_CI_CONFIG_PATH = '.gitlab-ci.yml'
+GITLAB_DEFAULT_HOST = 'https://gitlab.com'
+CONTRIBUTING_PATH = 'CONTRIBUTING.md'
+CODE_OF_CONDUCT_PATH = 'CODE_OF_CONDUCT.md'
+
+# Cap on files inspected in a repository tree, to bound work on huge repos.
+MAX_TREE_ENTRIES = 100000
+BINARY_ARTIFACT_EXTENSIONS = ('.a', '.bin', '.class', '.dll', '.dylib',
+                              '.exe', '.jar', '.lib', '.o', '.obj', '.pyc',
+                              '.so', '.war', '.whl')
+VENDORED_DIRECTORIES = frozenset(['node_modules', 'third_party', 'vendor'])
+SOURCE_FILE_EXTENSIONS = ('.c', '.cc', '.cpp', '.cs', '.go', '.h', '.hpp',
+                          '.java', '.js', '.jsx', '.kt', '.php', '.py', '.rb',
+                          '.rs', '.scala', '.swift', '.ts', '.tsx')
+# Name based heuristics for spotting test files among source files.
+TEST_FILE_PREFIXES = ('test_',)
+TEST_FILE_SUFFIXES = ('_test.go', '_test.py', '_test.rb', '_spec.rb',
+                      '.spec.js', '.spec.ts', '.test.js', '.test.ts',
+                      'test.java', 'tests.cs', 'test.kt', '_test.cc',
+                      '_unittest.cc')
+TEST_DIRECTORIES = frozenset(['__tests__', 'spec', 'test', 'tests'])
+
+# SPDX ids, as reported by GitHub, of common OSI approved licenses.
+OSI_APPROVED_LICENSES = frozenset([
+    '0BSD', 'AGPL-3.0', 'Apache-2.0', 'Artistic-2.0', 'BSD-2-Clause',
+    'BSD-3-Clause', 'BSL-1.0', 'CECILL-2.1', 'ECL-2.0', 'EPL-1.0', 'EPL-2.0',
+    'EUPL-1.1', 'EUPL-1.2', 'GPL-2.0', 'GPL-3.0', 'ISC', 'LGPL-2.1',
+    'LGPL-3.0', 'MIT', 'MPL-2.0', 'MS-PL', 'MS-RL', 'MulanPSL-2.0', 'NCSA',
+    'OSL-3.0', 'PostgreSQL', 'UPL-1.0', 'Unlicense', 'Zlib'
+])
 
 # Regex to match dependents count.
 DEPENDENTS_REGEX = re.compile(b'.*[^0-9,]([0-9,]+).*commit result', re.DOTALL)
+
+# Signature validity of the most recent default branch commits since a time.
+GITHUB_COMMIT_SIGNATURES_QUERY = """
+query($owner: String!, $name: String!, $since: GitTimestamp!, $count: Int!) {
+  repository(owner: $owner, name: $name) {
+    defaultBranchRef {
+      target {
+        ... on Commit {
+          history(first: $count, since: $since) {
+            nodes { signature { isValid } }
+          }
+        }
+      }
+    }
+  }
+}"""
+
+# Regexes to match dependency graph dependent counts.
+DEPENDENT_REPOS_REGEX = re.compile(rb'([0-9,]+)\s+Repositor(?:y|ies)')
+DEPENDENT_PACKAGES_REGEX = re.compile(rb'([0-9,]+)\s+Packages?')
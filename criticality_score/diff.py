@@ -0,0 +1,94 @@
+# Copyright 2020 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Report differences between two generated criticality score csvs."""
+
+import argparse
+import csv
+import logging
+
+from . import run
+
+logger = logging.getLogger()
+
+
+def read_results(filename):
+    """Return csv rows keyed by repository url, or by <owner>/<repo_name> for
+    results written without a url column (--omit-url)."""
+    with open(filename, newline='') as file_handle:
+        reader = csv.DictReader(file_handle)
+        fieldnames = reader.fieldnames or []
+        if 'url' in fieldnames:
+            return {row['url']: row for row in reader}
+        if 'owner' in fieldnames and 'repo_name' in fieldnames:
+            return {f"{row['owner']}/{row['repo_name']}": row for row in reader}
+        raise ValueError(
+            f'{filename} has neither a url nor owner and repo_name columns.')
+
+
+def get_delta(old_value, new_value):
+    """Return new_value - old_value if both are numbers, otherwise None."""
+    try:
+        return round(float(new_value) - float(old_value), 5)
+    except ValueError:
+        return None
+
+
+def diff_results(old_results, new_results):
+    """Yield (url, change, field, old value, new value, delta) tuples."""
+    for url in sorted(old_results.keys() - new_results.keys()):
+        yield url, 'removed', '', '', '', ''
+    for url in sorted(new_results.keys() - old_results.keys()):
+        yield url, 'added', '', '', '', ''
+    for url in sorted(old_results.keys() & new_results.keys()):
+        old_row = old_results[url]
+        new_row = new_results[url]
+        for field in old_row:
+            if field not in new_row or old_row[field] == new_row[field]:
+                continue
+            yield (url, 'changed', field, old_row[field], new_row[field],
+                   get_delta(old_row[field], new_row[field]))
+
+
+def main():
+    parser = argparse.ArgumentParser(
+        description='Report differences between two criticality score csvs.')
+    parser.add_argument("--old",
+                        type=str,
+                        required=True,
+                        help="Csv file from the earlier run.")
+    parser.add_argument("--new",
+                        type=str,
+                        required=True,
+                        help="Csv file from the later run.")
+    parser.add_argument("--output",
+                        type=str,
+                        required=True,
+                        help="Csv file to write the differences to.")
+
+    run.initialize_logging_handlers()
+
+    args = run.parse_args_with_config(parser)
+    old_results = read_results(args.old)
+    new_results = read_results(args.new)
+    with open(args.output, 'w', newline='') as file_handle:
+        csv_writer = csv.writer(file_handle)
+        csv_writer.writerow(
+            ['url', 'change', 'field', 'old_value', 'new_value', 'delta'])
+        for row in diff_results(old_results, new_results):
+            csv_writer.writerow(row)
+    logger.info(f'Wrote differences: {args.output}')
+
+
+if __name__ == "__main__":
+    main()
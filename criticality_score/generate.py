@@ -14,10 +14,22 @@
 """Main python script for calculating OSS Criticality Score."""
 
 import argparse
+import bisect
+import collections
 import csv
+import datetime
+import hashlib
+import heapq
+import importlib
+import json
 import logging
 import os
+import random
+import subprocess
+import sys
+import tempfile
 import time
+import uuid
 
 from . import run
 
@@ -38,6 +50,10 @@ LANGUAGE_SEARCH_MAP = {
 }
 IGNORED_KEYWORDS = ['docs', 'interview', 'tutorial']
 DEFAULT_SAMPLE_SIZE = 5000
+PROGRESS_LOG_INTERVAL = 25
+# Number of times a failing repo is moved to the end of the queue to be
+# retried later, e.g. after a transient outage has passed.
+DEFERRED_RETRIES = 1
 
 
 def get_github_repo_urls(sample_size, languages):
@@ -110,14 +126,263 @@ def get_github_repo_urls_for_orgs(orgs):
     return repo_urls
 
 
-def initialize_logging_handlers(output_dir):
+def log_progress(processed, total, start_time, last_budget):
+    """Log number of repos processed, average latency and estimated time
+    remaining.
+
+    The estimate accounts for the GitHub rate limit: the requests made per
+    repo are measured from the remaining budget since the last call, kept in
+    last_budget, and requests beyond the budget wait for it to reset."""
+    elapsed = time.time() - start_time
+    average = elapsed / processed
+    eta = average * (total - processed)
+    remaining_requests, hourly_limit, reset_seconds = (
+        run.get_github_rate_limit_budget())
+    rate_limit_message = (f'{remaining_requests} api requests left, reset in '
+                          f'{round(reset_seconds / 60, 1)} minutes')
+    # A reset in between refills the budget and spoils the sample.
+    if last_budget and last_budget['remaining_requests'] >= remaining_requests:
+        requests_per_repo = (
+            (last_budget['remaining_requests'] - remaining_requests) /
+            (processed - last_budget['processed']))
+        needed_requests = requests_per_repo * (total - processed)
+        rate_limit_message += f', ~{round(requests_per_repo)} requests per repo'
+        if needed_requests > remaining_requests and hourly_limit:
+            rate_limit_eta = reset_seconds + (
+                needed_requests - remaining_requests) / hourly_limit * 3600
+            eta = max(eta, rate_limit_eta)
+    last_budget['processed'] = processed
+    last_budget['remaining_requests'] = remaining_requests
+    logger.info(f'Progress: {processed}/{total} repos processed, '
+                f'{round(average, 1)}s per repo, {rate_limit_message}, '
+                f'ETA {round(eta / 60, 1)} minutes.')
+
+
+def get_percentile_rank(sorted_values, value):
+    """Return percentile rank in [0, 1] of value among sorted_values."""
+    if len(sorted_values) < 2:
+        return 1
+    left = bisect.bisect_left(sorted_values, value)
+    right = bisect.bisect_right(sorted_values, value)
+    return (left + right - 1) / (2 * (len(sorted_values) - 1))
+
+
+def update_percentile_score(stat, sorted_values, score_precision):
+    """Recompute the criticality score of stat, normalizing each param by its
+    percentile rank within sorted_values instead of its max threshold."""
+    total_weight = sum(weight for weight, _ in run.SCORED_PARAMS.values())
+    total_score = 0
+    for param, (weight, _) in run.SCORED_PARAMS.items():
+        total_score += get_percentile_rank(sorted_values[param],
+                                           stat[param]) * weight
+    criticality_score = round(total_score / total_weight, score_precision)
+    stat['criticality_score'] = max(min(criticality_score, 1), 0)
+    return stat
+
+
+def update_percentile_scores(stats, score_precision):
+    """Recompute criticality scores, normalizing each param by its
+    percentile rank within stats instead of its max threshold."""
+    sorted_values = {
+        param: sorted(i[param] for i in stats)
+        for param in run.SCORED_PARAMS
+    }
+    for i in stats:
+        update_percentile_score(i, sorted_values, score_precision)
+
+
+def read_spilled_stats(spill_file, sorted_values, score_mode,
+                       score_precision):
+    """Yield the stats written one json object per line to spill_file,
+    rescored by percentile in that score mode."""
+    spill_file.seek(0)
+    for line in spill_file:
+        stat = json.loads(line)
+        if score_mode == 'percentile':
+            update_percentile_score(stat, sorted_values, score_precision)
+        yield stat
+
+
+def parse_extra_columns(extra_columns):
+    """Return extra columns given in form <key>=<value> as a dict."""
+    reserved_keys = set(['name', 'url', 'language', 'criticality_score',
+                         'status', 'run_id', 'scoring_hash'] + run.PARAMS +
+                        run.EXTRA_PARAMS + run.get_param_status_columns(
+                            run.PARAMS + run.EXTRA_PARAMS))
+    columns = {}
+    for extra_column in extra_columns:
+        key, sep, value = extra_column.partition('=')
+        assert key and sep, f'Extra column in bad format: {extra_column}'
+        assert key not in columns, f'Duplicate extra column: {key}'
+        assert key not in reserved_keys, f'Extra column is reserved: {key}'
+        columns[key] = value
+    return columns
+
+
+def get_output_schema(args, extra_columns):
+    """Return a JSON schema of the rows written with args."""
+    column_names = list(extra_columns)
+    if args.include_uncollectable:
+        column_names.append('status')
+    # Placeholder and anonymized rows leave columns empty.
+    schema = run.get_output_schema(
+        run.get_enabled_params(),
+        args.param_status,
+        extra_columns=column_names,
+        nullable=bool(args.include_uncollectable or args.anonymize_salt))
+    if args.omit_url:
+        del schema['properties']['url']
+        schema['required'].remove('url')
+    return schema
+
+
+def new_run_id():
+    """Return a unique run id that sorts by the time the run started."""
+    started_at = datetime.datetime.utcnow().strftime('%Y%m%dT%H%M%SZ')
+    return f'{started_at}-{uuid.uuid4().hex[:8]}'
+
+
+def load_checkpoint(checkpoint_filename):
+    """Return the stats of completed repos keyed by url, None for the ones
+    that could not be collected."""
+    if not os.path.exists(checkpoint_filename):
+        return {}
+    with open(checkpoint_filename) as file_handle:
+        return json.load(file_handle)
+
+
+def write_checkpoint(checkpoint_filename, completed):
+    """Atomically replace the checkpoint with the completed repos."""
+    temp_filename = checkpoint_filename + '.tmp'
+    with open(temp_filename, 'w') as file_handle:
+        json.dump(completed, file_handle)
+    os.replace(temp_filename, checkpoint_filename)
+
+
+def load_row_hook(hook):
+    """Return the function given in form <module>:<function>. It is called
+    with each output row as a dict and returns the row to write, or None to
+    drop it."""
+    module_name, _, function_name = hook.partition(':')
+    assert module_name and function_name, (
+        f'Row hook must be in form <module>:<function>: {hook}')
+    return getattr(importlib.import_module(module_name), function_name)
+
+
+def anonymize_value(value, salt):
+    """Return a salted sha256 pseudonym for an identifying value, e.g. a
+    repository url."""
+    return hashlib.sha256(f'{salt}{value}'.encode('utf-8')).hexdigest()
+
+
+def anonymize_row(row, salt):
+    """Replace the columns identifying a repository in row: the url, owner
+    and repo_name by salted hashes, which still allow joins, and the free
+    text columns, which cannot be hashed usefully, by None."""
+    for column in ('url', 'redirected_from', 'owner', 'repo_name'):
+        if row.get(column):
+            row[column] = anonymize_value(row[column], salt)
+    for column in ('name', 'homepage', 'description', 'topics'):
+        if column in row:
+            row[column] = None
+
+
+def get_tool_version():
+    """Return the installed criticality_score version, if known."""
+    try:
+        from importlib import metadata  # pylint: disable=import-outside-toplevel
+        return metadata.version('criticality_score')
+    except Exception:
+        return 'unknown'
+
+
+def get_git_commit():
+    """Return the git commit of the criticality_score checkout, or None if it
+    is not run from one."""
+    try:
+        return subprocess.run(['git', 'rev-parse', 'HEAD'],
+                              cwd=os.path.dirname(os.path.abspath(__file__)),
+                              stdout=subprocess.PIPE,
+                              stderr=subprocess.DEVNULL,
+                              universal_newlines=True,
+                              check=True).stdout.strip()
+    except (OSError, subprocess.CalledProcessError):
+        return None
+
+
+def get_provenance(args, start_time, total_count):
+    """Return metadata describing how a set of results was produced."""
+    started_at = datetime.datetime.utcfromtimestamp(start_time)
+    return {
+        'tool_version': get_tool_version(),
+        'git_commit': get_git_commit(),
+        # The salt would undo the anonymization of urls.
+        'arguments': {
+            key: value
+            for key, value in vars(args).items()
+            if key != 'anonymize_salt'
+        },
+        'params': run.get_enabled_params(),
+        'scored_params': {
+            param: {
+                'weight': weight,
+                'max_threshold': max_threshold
+            } for param, (weight, max_threshold) in run.SCORED_PARAMS.items()
+        },
+        'scoring_hash': run.get_scoring_hash(
+            score_mode=args.score_mode, score_precision=args.score_precision),
+        'run_id': args.run_id,
+        'started_at': started_at.isoformat() + 'Z',
+        'finished_at': datetime.datetime.utcnow().isoformat() + 'Z',
+        'total_count': total_count,
+    }
+
+
+def write_manifest(output_filename, header, row_count, provenance):
+    """Write a manifest next to output_filename to verify its integrity and
+    record its provenance."""
+    sha256 = hashlib.sha256()
+    with open(output_filename, 'rb') as file_handle:
+        for chunk in iter(lambda: file_handle.read(65536), b''):
+            sha256.update(chunk)
+    manifest = {
+        'file': os.path.basename(output_filename),
+        'size': os.path.getsize(output_filename),
+        'row_count': row_count,
+        'sha256': sha256.hexdigest(),
+        'header': header,
+        'created_at': datetime.datetime.utcnow().isoformat() + 'Z',
+        'provenance': provenance,
+    }
+    manifest_filename = output_filename + '.manifest.json'
+    with open(manifest_filename, 'w') as file_handle:
+        json.dump(manifest, file_handle, indent=4)
+    logger.info(f'Wrote manifest: {manifest_filename}')
+
+
+def write_run_summary(processed, succeeded, failed, skipped, start_time):
+    """Write counts of the run as a single json line to stderr. Skipped repos
+    were left out by --sample-rate, are not collectable repositories, scored
+    below --min-score or were dropped by the row hook."""
+    summary = {
+        'processed': processed,
+        'succeeded': succeeded,
+        'failed': failed,
+        'skipped': skipped,
+        'elapsed_seconds': round(time.time() - start_time, 1),
+    }
+    print(json.dumps(summary), file=sys.stderr, flush=True)
+
+
+def initialize_logging_handlers(output_dir, quiet=False):
     log_filename = os.path.join(output_dir, 'output.log')
     logging.basicConfig(filename=log_filename,
                         filemode='w',
                         level=logging.INFO)
 
-    console = logging.StreamHandler()
-    console.setLevel(logging.INFO)
+    console = logging.StreamHandler(sys.stderr)
+    # The log file keeps everything, quiet only affects the console.
+    console.setLevel(logging.WARNING if quiet else logging.INFO)
     logging.getLogger('').addHandler(console)
 
 
@@ -148,13 +413,218 @@ def main():
                         default=[],
                         required=False,
                         help="List of organizations for populating the repos.")
+    parser.add_argument(
+        "--package",
+        nargs='+',
+        default=[],
+        required=False,
+        help="List of packages in form <system>/<name> (e.g. npm/lodash), "
+        "whose source repositories are looked up on deps.dev and analyzed.")
+    parser.add_argument(
+        "--format",
+        type=str,
+        default='csv',
+        choices=['csv', 'json'],
+        help="Write results as csv, or as a single json array.")
+    parser.add_argument(
+        "--null-value",
+        type=str,
+        default='',
+        help="Value written to csv for unset params, e.g. NULL or \\N. "
+        "Defaults to an empty string. Json output always uses null.")
+    parser.add_argument(
+        "--min-score",
+        type=float,
+        default=0,
+        help="Drop projects with a criticality score below this threshold.")
+    parser.add_argument(
+        "--include-uncollectable",
+        action='store_true',
+        help="Write a placeholder row with a status column for projects that "
+        "could not be collected, instead of dropping them.")
+    parser.add_argument(
+        "--score-mode",
+        type=str,
+        default='threshold',
+        choices=['threshold', 'percentile'],
+        help="Normalize params by their max threshold, or by their percentile "
+        "rank among all analyzed projects.")
+    parser.add_argument(
+        "--shuffle",
+        action='store_true',
+        help="Analyze projects in random order instead of sorted by url, to "
+        "spread load across organizations.")
+    parser.add_argument(
+        "--sample-rate",
+        type=float,
+        default=1,
+        help="Independently include each found project with this probability "
+        "(0 < p <= 1), for representative samples.")
+    parser.add_argument(
+        "--seed",
+        type=int,
+        help="Random seed for --shuffle and --sample-rate, for "
+        "reproducibility.")
+    parser.add_argument(
+        "--extra-column",
+        nargs='+',
+        default=[],
+        required=False,
+        help="Constant columns to add to every result, in form <key>=<value>.")
+    parser.add_argument(
+        "--timeout",
+        type=int,
+        help="Give up on a project if computing its scored params takes longer "
+        "than this many seconds. Unscored params still running are left "
+        "empty.")
+    parser.add_argument(
+        "--manifest",
+        action='store_true',
+        help="Also write a manifest with the size, row count and sha256 of "
+        "the results, and how they were produced.")
+    parser.add_argument("--score-precision",
+                        type=int,
+                        default=run.SCORE_PRECISION,
+                        help="Number of decimal places in the criticality "
+                        "score.")
+    parser.add_argument(
+        "--errors-out",
+        type=str,
+        help="Csv file to record projects that failed, with the error, for a "
+        "later retry.")
+    parser.add_argument(
+        "--review-out",
+        type=str,
+        help="Csv file to record urls that are not collectable repositories, "
+        "e.g. org pages or unsupported hosts, with the reason. They are "
+        "skipped.")
+    parser.add_argument(
+        "--anonymize-salt",
+        type=str,
+        help="Replace the url, redirected_from, owner and repo_name columns "
+        "with sha256 hashes salted with this value, and leave out name, "
+        "homepage, description and topics. The same salt gives the same "
+        "pseudonyms across runs.")
+    parser.add_argument(
+        "--progress",
+        action='store_true',
+        default=None,
+        help="Periodically log progress with a rate limit aware ETA. On by "
+        "default when stderr is a terminal.")
+    parser.add_argument("--no-progress",
+                        dest='progress',
+                        action='store_false',
+                        help="Do not log progress.")
+    parser.add_argument(
+        "--quiet",
+        action='store_true',
+        help="Only log warnings and errors to the console. A json summary of "
+        "the run is still written to stderr at the end.")
+    parser.add_argument(
+        "--run-id",
+        type=str,
+        nargs='?',
+        const='',
+        help="Add a run_id column with this value to every row, and to the "
+        "manifest. Without a value, a unique id is generated.")
+    parser.add_argument(
+        "--param-status",
+        action='store_true',
+        help="Add a <param>_status column for each unscored param: ok, or "
+        "error or timeout if it was left empty because collecting it failed.")
+    parser.add_argument(
+        "--scoring-hash-column",
+        action='store_true',
+        help="Add a scoring_hash column to every row, a fingerprint of the "
+        "weights, thresholds, score mode and activity filter the scores were "
+        "computed with. It is always recorded in the manifest.")
+    parser.add_argument(
+        "--checkpoint",
+        type=str,
+        help="Json file to periodically record completed repos and their "
+        "stats in.")
+    parser.add_argument(
+        "--resume",
+        action='store_true',
+        help="Skip repos already completed in the --checkpoint file and "
+        "include their stats in the results.")
+    parser.add_argument(
+        "--omit-url",
+        action='store_true',
+        help="Leave out the url column, e.g. when the owner and repo_name "
+        "columns are enough.")
+    parser.add_argument(
+        "--max-memory-mb",
+        type=int,
+        help="Keep collected stats in a temporary file once they take more "
+        "than this many megabytes, and only hold the top --count results in "
+        "memory while ranking. Cannot be combined with --checkpoint.")
+    parser.add_argument(
+        "--row-hook",
+        type=str,
+        help="Function in form <module>:<function> called with each result "
+        "row as a dict. It returns the row to write, which may have extra "
+        "columns, or None to drop it.")
+    parser.add_argument(
+        "--print-schema",
+        action='store_true',
+        help="Print a JSON schema of the output columns for the other flags, "
+        "e.g. --extra-params or --extra-column, and exit. Columns added by a "
+        "row hook are not included.")
+    run.add_activity_filter_arguments(parser)
+    run.add_extra_params_argument(parser)
 
-    args = parser.parse_args()
+    args = run.parse_args_with_config(parser)
+    assert 0 < args.sample_rate <= 1, 'Sample rate must be in (0, 1].'
+    assert args.checkpoint or not args.resume, 'Resume needs a checkpoint.'
+    # The checkpoint holds every collected result in memory.
+    assert not (args.checkpoint and args.max_memory_mb), (
+        'Checkpoint is not supported with max memory.')
+    extra_columns = parse_extra_columns(args.extra_column)
+    if args.progress is None:
+        args.progress = sys.stderr.isatty()
+    run.set_activity_filter_from_args(args)
+    run.set_extra_params_from_args(args)
+    if args.run_id == '':
+        args.run_id = new_run_id()
+    if args.run_id is not None:
+        extra_columns['run_id'] = args.run_id
+    if args.scoring_hash_column:
+        extra_columns['scoring_hash'] = run.get_scoring_hash(
+            score_mode=args.score_mode, score_precision=args.score_precision)
+    row_hook = load_row_hook(args.row_hook) if args.row_hook else None
+    if args.print_schema:
+        print(json.dumps(get_output_schema(args, extra_columns), indent=4))
+        return
 
-    initialize_logging_handlers(args.output_dir)
+    initialize_logging_handlers(args.output_dir, args.quiet)
+    if args.run_id:
+        logger.info(f'Run id: {args.run_id}')
+    # Fail early rather than on every repo of a long run.
+    run.validate_auth_tokens()
 
+    review_file_handle = None
+    if args.review_out:
+        review_file_handle, review_csv_writer = run.open_review_file(
+            args.review_out)
+    rejected_count = 0
     repo_urls = set()
-    if args.org:
+    if args.package:
+        assert not args.org and not args.language and not args.sample_size, (
+            'Packages are not supported with orgs, languages or sample size.')
+        for package in args.package:
+            repo_url = run.resolve_package_repo_url(package)
+            if not repo_url:
+                logger.error(f'Source repo is not found: {package}')
+                rejected_count += 1
+                if review_file_handle:
+                    review_csv_writer.writerow(
+                        [package, run.PACKAGE_NOT_RESOLVED_REASON])
+                continue
+            repo_urls.add(run.normalize_repo_url(repo_url))
+        logger.info(f'Resolved {len(repo_urls)} of {len(args.package)} '
+                    f'packages.')
+    elif args.org:
         assert not args.language, 'Languages is not supported with orgs.'
         assert not args.sample_size, 'Sample size is not supported with orgs.'
         repo_urls.update(get_github_repo_urls_for_orgs(args.org))
@@ -169,42 +639,233 @@ def main():
                 get_github_repo_urls(args.sample_size, args.language))
 
     stats = []
+    spill_file = None
+    sorted_values = {param: [] for param in run.SCORED_PARAMS}
+    if args.max_memory_mb:
+        # Stays in memory until it grows past max_size, then moves to disk.
+        spill_file = tempfile.SpooledTemporaryFile(
+            max_size=args.max_memory_mb * 1024 * 1024, mode='w+')
+    uncollectable_urls = []
     index = 1
-    for repo_url in sorted(repo_urls):
+    errors_file_handle = None
+    if args.errors_out:
+        errors_file_handle = open(args.errors_out, 'w')
+        errors_csv_writer = csv.writer(errors_file_handle)
+        errors_csv_writer.writerow(['url', 'error', 'message'])
+    start_time = time.time()
+    rng = random.Random(args.seed)
+    repo_urls = sorted(repo_urls)
+    sampled_out_count = 0
+    if args.sample_rate < 1:
+        found_count = len(repo_urls)
+        repo_urls = [u for u in repo_urls if rng.random() < args.sample_rate]
+        sampled_out_count = found_count - len(repo_urls)
+        logger.info(f'Sampled {len(repo_urls)} repos.')
+    if args.shuffle:
+        rng.shuffle(repo_urls)
+    # Completed repos are keyed by url, so the checkpoint does not depend on
+    # the order they were processed in.
+    completed = {}
+    if args.resume:
+        completed = load_checkpoint(args.checkpoint)
+        for repo_url, output in completed.items():
+            if output:
+                stats.append(output)
+            else:
+                uncollectable_urls.append(repo_url)
+        repo_urls = [u for u in repo_urls if u not in completed]
+        index = len(stats) + 1
+        logger.info(f'Resuming after {len(completed)} completed repos.')
+    deferred_retries = collections.Counter()
+    last_budget = {}
+    # Deferred retries are appended to repo_urls while iterating over it.
+    for processed, repo_url in enumerate(repo_urls):
+        if processed and processed % PROGRESS_LOG_INTERVAL == 0:
+            if args.progress:
+                log_progress(processed, len(repo_urls), start_time,
+                             last_budget)
+            if args.checkpoint:
+                write_checkpoint(args.checkpoint, completed)
+        review_reason = run.get_url_review_reason(repo_url)
+        if review_reason:
+            logger.error(
+                f'Url is not a repository ({review_reason}): {repo_url}')
+            rejected_count += 1
+            if review_file_handle:
+                review_csv_writer.writerow([repo_url, review_reason])
+                review_file_handle.flush()
+            continue
         output = None
+        error = None
         for _ in range(3):
+            retryable = False
             try:
                 repo = run.get_repository(repo_url)
                 if not repo:
                     logger.error(f'Repo is not found: {repo_url}')
+                    error = ('NotFound', 'Repo is not found')
                     break
-                output = run.get_repository_stats(repo)
+                output = run.get_repository_stats(
+                    repo,
+                    timeout=args.timeout,
+                    score_precision=args.score_precision,
+                    param_status=args.param_status)
+                if not output:
+                    error = ('Empty', 'Repo is empty')
+                break
+            except run.DeadlineExceededError as exp:
+                # Retrying would most likely time out again.
+                logger.error(str(exp))
+                error = (type(exp).__name__, str(exp))
                 break
             except Exception as exp:
                 logger.exception(
                     f'Exception occurred when reading repo: {repo_url}\n{exp}')
+                error = (type(exp).__name__, str(exp))
+                # E.g. a missing resource fails the same way every time.
+                retryable = run.is_retryable_error(exp)
+                if not retryable:
+                    break
+        if not output and retryable and (deferred_retries[repo_url] <
+                                         DEFERRED_RETRIES):
+            logger.info(f'Deferring retry to end of queue: {repo_url}')
+            deferred_retries[repo_url] += 1
+            repo_urls.append(repo_url)
+            continue
         if not output:
+            uncollectable_urls.append(repo_url)
+            completed[repo_url] = None
+            if errors_file_handle:
+                errors_csv_writer.writerow([repo_url, *error])
+                errors_file_handle.flush()
             continue
         logger.info(f"{index} - {output['name']} - {output['url']} - "
                     f"{output['criticality_score']}")
-        stats.append(output)
+        if spill_file:
+            spill_file.write(json.dumps(output) + '\n')
+            for param in run.SCORED_PARAMS:
+                sorted_values[param].append(output[param])
+        else:
+            stats.append(output)
+            completed[repo_url] = output
         index += 1
 
-    if len(stats) == 0:
+    collected_count = index - 1
+
+    if args.checkpoint:
+        write_checkpoint(args.checkpoint, completed)
+
+    if errors_file_handle:
+        errors_file_handle.close()
+        logger.info(f'Wrote errors: {args.errors_out}')
+    if review_file_handle:
+        review_file_handle.close()
+        logger.info(f'Wrote urls to review: {args.review_out}')
+
+    run.log_param_durations()
+    if collected_count == 0 and not args.include_uncollectable:
+        write_run_summary(
+            len(uncollectable_urls) + sampled_out_count + rejected_count, 0,
+            len(uncollectable_urls), sampled_out_count + rejected_count,
+            start_time)
         return
+    if spill_file:
+        for values in sorted_values.values():
+            values.sort()
+        ranked_stats = read_spilled_stats(spill_file, sorted_values,
+                                          args.score_mode,
+                                          args.score_precision)
+    else:
+        if args.score_mode == 'percentile':
+            update_percentile_scores(stats, args.score_precision)
+        ranked_stats = stats
+    # Same order as a stable sort by score, holding at most count stats.
+    top_stats = heapq.nlargest(args.count,
+                               ranked_stats,
+                               key=lambda i: i['criticality_score'])
+    if spill_file:
+        spill_file.close()
+    if top_stats:
+        header = list(top_stats[0].keys())
+    else:
+        # Every repo failed, the placeholders still need the usual columns.
+        params = run.get_enabled_params()
+        header = ['name', 'url', 'language'] + params + ['criticality_score']
+        if args.param_status:
+            header.extend(run.get_param_status_columns(params))
+    # Extra columns are added at write time, so the checkpoint of a resumed
+    # run does not carry the run_id or other extra columns of the first run.
+    header.extend(k for k in extra_columns if k not in header)
+    if args.include_uncollectable:
+        header.append('status')
+    rows = []
+    suppressed_count = 0
+    hook_dropped_count = 0
+    for i in top_stats:
+        if i['criticality_score'] < args.min_score:
+            suppressed_count += 1
+            continue
+        row = dict(i)
+        row.update(extra_columns)
+        if args.include_uncollectable:
+            row['status'] = 'ok'
+        if row_hook:
+            row = row_hook(row)
+            if row is None:
+                hook_dropped_count += 1
+                continue
+            header.extend(k for k in row if k not in header)
+        rows.append(row)
+    if args.include_uncollectable:
+        for repo_url in uncollectable_urls:
+            placeholder = dict.fromkeys(header)
+            placeholder.update(extra_columns)
+            placeholder['url'] = repo_url
+            # Keeps the placeholder identifiable with --omit-url.
+            placeholder['owner'], placeholder['repo_name'] = (
+                run.split_repo_path(repo_url))
+            placeholder['status'] = 'uncollectable'
+            rows.append(placeholder)
+    if args.anonymize_salt:
+        for row in rows:
+            anonymize_row(row, args.anonymize_salt)
+    if args.omit_url:
+        header.remove('url')
+        for row in rows:
+            row.pop('url', None)
+
     languages = '_'.join(args.language) if args.language else 'all'
     languages = languages.replace('+', 'plus').replace('c#', 'csharp')
-    output_filename = os.path.join(args.output_dir,
-                                   f'{languages}_top_{args.count}.csv')
+    output_filename = os.path.join(
+        args.output_dir, f'{languages}_top_{args.count}.{args.format}')
     with open(output_filename, 'w') as file_handle:
-        csv_writer = csv.writer(file_handle)
-        header = output.keys()
-        csv_writer.writerow(header)
-        for i in sorted(stats,
-                        key=lambda i: i['criticality_score'],
-                        reverse=True)[:args.count]:
-            csv_writer.writerow(i.values())
+        if args.format == 'json':
+            json.dump(rows, file_handle, indent=4)
+        else:
+            csv_writer = csv.writer(file_handle)
+            csv_writer.writerow(header)
+            for row in rows:
+                csv_writer.writerow([
+                    args.null_value if row.get(column) is None else
+                    row[column] for column in header
+                ])
+    if suppressed_count:
+        logger.info(f'Dropped {suppressed_count} results with criticality '
+                    f'score below {args.min_score}.')
+    if hook_dropped_count:
+        logger.info(f'Dropped {hook_dropped_count} results in the row hook.')
     logger.info(f'Wrote results: {output_filename}')
+    if args.manifest:
+        write_manifest(
+            output_filename, header, len(rows),
+            get_provenance(args, start_time,
+                           collected_count + len(uncollectable_urls)))
+    skipped_count = (sampled_out_count + rejected_count + suppressed_count +
+                     hook_dropped_count)
+    write_run_summary(
+        collected_count + len(uncollectable_urls) + sampled_out_count +
+        rejected_count, collected_count - suppressed_count - hook_dropped_count,
+        len(uncollectable_urls), skipped_count, start_time)
 
 
 if __name__ == "__main__":
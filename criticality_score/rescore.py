@@ -0,0 +1,154 @@
+# Copyright 2020 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Recompute criticality scores for a previously generated csv."""
+
+import argparse
+import csv
+import json
+import logging
+import sys
+
+from . import run
+
+logger = logging.getLogger()
+
+
+def rescore_rows(rows,
+                 additional_params=None,
+                 score_precision=run.SCORE_PRECISION):
+    """Yield rows with the criticality score recomputed from their stats.
+    Placeholder rows of uncollectable repos, whose status is not ok, have no
+    stats and are passed through as is.
+
+    The scoring_hash and normalized param columns, where present, are
+    recomputed too, so they describe the new score. The hash includes the
+    activity filter set with run.set_activity_filter."""
+    scoring_hash = run.get_scoring_hash(additional_params,
+                                        score_precision=score_precision)
+    additional_params_score, additional_params_total_weight = (
+        run.get_additional_params_score(additional_params))
+    for row in rows:
+        if row.get('status') not in (None, '', 'ok'):
+            yield row
+            continue
+        stats = {}
+        for param in run.SCORED_PARAMS:
+            try:
+                stats[param] = float(row[param])
+            except (KeyError, TypeError, ValueError):
+                logger.error(f'Missing or bad value for {param}: {row}')
+                sys.exit(1)
+        row['criticality_score'] = run.get_criticality_score(
+            stats, additional_params_score, additional_params_total_weight,
+            score_precision)
+        for key, value in run.get_normalized_param_values(stats).items():
+            if key in row:
+                row[key] = value
+        if 'scoring_hash' in row:
+            row['scoring_hash'] = scoring_hash
+        yield row
+
+
+def read_ndjson_rows(input_handle, extra_fields=None):
+    """Yield rows from newline delimited json, rejecting unknown fields.
+
+    Fields the tools write themselves are known, e.g. run_id and the
+    normalized and status columns of the params. Extra columns and row hook
+    fields are only known if listed in extra_fields."""
+    known_fields = set(
+        ['name', 'url', 'language', 'criticality_score', 'status', 'run_id',
+         'scoring_hash'] + run.PARAMS + run.EXTRA_PARAMS +
+        run.get_param_status_columns(run.PARAMS + run.EXTRA_PARAMS) +
+        [f'{param}_normalized' for param in run.SCORED_PARAMS] +
+        list(extra_fields or []))
+    for line_number, line in enumerate(input_handle, 1):
+        if not line.strip():
+            continue
+        try:
+            row = json.loads(line)
+        except ValueError as exp:
+            logger.error(f'Bad json on line {line_number}: {exp}')
+            sys.exit(1)
+        if not isinstance(row, dict):
+            logger.error(f'Expected a json object on line {line_number}.')
+            sys.exit(1)
+        unknown_fields = sorted(row.keys() - known_fields)
+        if unknown_fields:
+            logger.error(f'Unknown fields on line {line_number}: '
+                         f'{", ".join(unknown_fields)}')
+            sys.exit(1)
+        yield row
+
+
+def main():
+    parser = argparse.ArgumentParser(
+        description='Recompute criticality scores for an existing csv.')
+    parser.add_argument("--input",
+                        type=str,
+                        help="Csv file written by criticality_score.")
+    parser.add_argument("--output",
+                        type=str,
+                        help="Csv file to write the rescored results to.")
+    parser.add_argument("--ndjson",
+                        action='store_true',
+                        help="Read newline delimited json records from stdin "
+                        "and write the rescored records to stdout.")
+    parser.add_argument("--extra-fields",
+                        nargs='+',
+                        default=[],
+                        help="Other fields to pass through with --ndjson, "
+                        "e.g. the keys of the generator's --extra-column.")
+    parser.add_argument(
+        '--params',
+        nargs='+',
+        default=[],
+        help='Additional parameters in form <value>:<weight>:<max_threshold>',
+        required=False)
+    parser.add_argument("--score-precision",
+                        type=int,
+                        default=run.SCORE_PRECISION,
+                        help="Number of decimal places in the criticality "
+                        "score.")
+    # Only recorded in the scoring_hash column, describing how the stats were
+    # collected.
+    run.add_activity_filter_arguments(parser)
+
+    run.initialize_logging_handlers()
+
+    args = run.parse_args_with_config(parser)
+    run.set_activity_filter_from_args(args)
+    if args.ndjson:
+        rows = read_ndjson_rows(sys.stdin, args.extra_fields)
+        for row in rescore_rows(rows, args.params, args.score_precision):
+            print(json.dumps(row), flush=True)
+        return
+    if not args.input or not args.output:
+        parser.error('--input and --output are required without --ndjson.')
+    with open(args.input, newline='') as input_handle:
+        reader = csv.DictReader(input_handle)
+        fieldnames = list(reader.fieldnames or [])
+        if 'criticality_score' not in fieldnames:
+            fieldnames.append('criticality_score')
+        # Rescore everything first, so a bad row does not leave a partly
+        # written output.
+        rows = list(rescore_rows(reader, args.params, args.score_precision))
+    with open(args.output, 'w', newline='') as output_handle:
+        writer = csv.DictWriter(output_handle, fieldnames=fieldnames)
+        writer.writeheader()
+        writer.writerows(rows)
+    logger.info(f'Wrote {len(rows)} rescored results: {args.output}')
+
+
+if __name__ == "__main__":
+    main()
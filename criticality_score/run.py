@@ -14,8 +14,11 @@
 """Main python script for calculating OSS Criticality Score."""
 
 import argparse
+import collections
 import csv
 import datetime
+import functools
+import hashlib
 import json
 import logging
 import math
@@ -23,7 +26,7 @@ import os
 import sys
 import threading
 import time
-import urllib
+import urllib.parse
 
 import github
 import gitlab
@@ -35,20 +38,92 @@ logger = logging.getLogger()
 
 _CACHED_GITHUB_TOKEN = None
 _CACHED_GITHUB_TOKEN_OBJ = None
+_CACHED_GITHUB_APP_TOKEN = None
+_PARAM_DURATIONS = collections.defaultdict(list)
+_PARAM_DURATIONS_LOCK = threading.Lock()
+# Which issues count as activity and the activity windows, see
+# set_activity_filter.
+_ACTIVITY_FILTER = {
+    'include_labels': [],
+    'exclude_labels': [],
+    'issue_lookback_days': None,
+    'window_days': None,
+    'stale_pr_days': STALE_PR_DAYS,
+}
 
 PARAMS = [
-    'description', 'created_since', 'updated_since', 'contributor_count', 'watchers_count', 'org_count',
-    'commit_frequency', 'recent_releases_count', 'updated_issues_count',
-    'closed_issues_count', 'comment_frequency', 'dependents_count'
+    'description', 'created_since', 'updated_since', 'contributor_count',
+    'watchers_count', 'org_count', 'commit_frequency',
+    'recent_releases_count', 'updated_issues_count', 'closed_issues_count',
+    'comment_frequency', 'dependents_count', 'redirected_from', 'ref',
+    'owner', 'repo_name'
 ]
 
+# Unscored params only collected when enabled with set_extra_params. Most of
+# them cost extra api requests per repository, and every param runs in its
+# own thread, so enabling all of them multiplies the concurrent requests.
+EXTRA_PARAMS = [
+    'homepage', 'has_ci', 'workflow_count', 'repo_age_days',
+    'default_branch_protected', 'topics', 'topic_count', 'has_contributing',
+    'has_code_of_conduct', 'repo_size_kb', 'loc_estimate',
+    'active_weeks_count', 'commit_count_1y', 'committer_count_1y',
+    'github_dependent_repo_count', 'github_dependent_package_count',
+    'license', 'has_osi_approved_license', 'default_branch', 'open_pr_count',
+    'stale_pr_fraction', 'binary_artifact_count', 'has_vendored_deps',
+    'subscriber_count', 'test_file_count', 'test_to_source_ratio',
+    'good_first_issue_count', 'help_wanted_count', 'visibility', 'fork_count',
+    'network_size', 'signed_commit_fraction'
+]
+_ENABLED_EXTRA_PARAMS = []
+
+# Scored params mapped to their (weight, max threshold).
+SCORED_PARAMS = {
+    'created_since': (CREATED_SINCE_WEIGHT, CREATED_SINCE_THRESHOLD),
+    'updated_since': (UPDATED_SINCE_WEIGHT, UPDATED_SINCE_THRESHOLD),
+    'contributor_count':
+    (CONTRIBUTOR_COUNT_WEIGHT, CONTRIBUTOR_COUNT_THRESHOLD),
+    'org_count': (ORG_COUNT_WEIGHT, ORG_COUNT_THRESHOLD),
+    'commit_frequency': (COMMIT_FREQUENCY_WEIGHT, COMMIT_FREQUENCY_THRESHOLD),
+    'recent_releases_count':
+    (RECENT_RELEASES_WEIGHT, RECENT_RELEASES_THRESHOLD),
+    'closed_issues_count': (CLOSED_ISSUES_WEIGHT, CLOSED_ISSUES_THRESHOLD),
+    'updated_issues_count': (UPDATED_ISSUES_WEIGHT, UPDATED_ISSUES_THRESHOLD),
+    'comment_frequency':
+    (COMMENT_FREQUENCY_WEIGHT, COMMENT_FREQUENCY_THRESHOLD),
+    'dependents_count': (DEPENDENTS_COUNT_WEIGHT, DEPENDENTS_COUNT_THRESHOLD),
+}
+
+
+def _cached(method):
+    """Run a Repository helper once per repository and share its result
+    between the params calling it, which run in separate threads. Errors are
+    not cached, so a retried param calls the helper again."""
+    @functools.wraps(method)
+    def wrapper(self):
+        with self._cache_lock:
+            key_lock = self._cache_key_locks[method.__name__]
+        with key_lock:
+            if method.__name__ not in self._cache:
+                self._cache[method.__name__] = method(self)
+            return self._cache[method.__name__]
+
+    return wrapper
+
 
 class Repository:
     """General source repository."""
-    def __init__(self, repo):
+    def __init__(self, repo, redirected_from=None, ref=None, github_token=None):
         self._repo = repo
         self._last_commit = None
         self._created_since = None
+        self._redirected_from = redirected_from
+        self._ref = ref
+        # Token of the client that fetched the repository, if not the cached
+        # one, for requests made outside of that client.
+        self._github_token = github_token
+        self._cache = {}
+        self._cache_lock = threading.Lock()
+        self._cache_key_locks = collections.defaultdict(threading.Lock)
 
     @property
     def name(self):
@@ -63,7 +138,24 @@ class Repository:
         raise NotImplementedError
 
     @property
-    def description(self):
+    def owner(self) -> str:
+        """Url path up to the repository, e.g. the user or org on GitHub and
+        the full group path, which can be nested, on GitLab."""
+        return split_repo_path(self.url)[0]
+
+    @property
+    def repo_name(self) -> str:
+        """Last url path segment, unlike name which can be a display name."""
+        return split_repo_path(self.url)[1]
+
+    @property
+    def description(self) -> str:
+        """Short description of the repository, or None if not set."""
+        raise NotImplementedError
+
+    @property
+    def homepage(self) -> str:
+        """Homepage url of the project, or None if not set."""
         raise NotImplementedError
 
     @property
@@ -71,54 +163,371 @@ class Repository:
         raise NotImplementedError
 
     @property
-    def created_since(self):
+    def created_since(self) -> int:
+        """Months since the repository was created, or since its first commit
+        if that is older."""
         raise NotImplementedError
 
     @property
-    def updated_since(self):
+    def updated_since(self) -> int:
+        """Months since the last commit."""
         raise NotImplementedError
 
     @property
-    def contributor_count(self):
+    def repo_age_days(self) -> int:
+        """Days since the repository was created."""
         raise NotImplementedError
 
     @property
-    def watchers_count(self):
+    def contributor_count(self) -> int:
+        """Number of contributors, capped at 5000 on GitHub."""
         raise NotImplementedError
 
     @property
-    def org_count(self):
+    def watchers_count(self) -> int:
+        """Number of stars. GitHub's api still calls these watchers."""
         raise NotImplementedError
 
     @property
-    def commit_frequency(self):
+    def subscriber_count(self) -> int:
+        """Number of users watching for notifications, unlike stars."""
         raise NotImplementedError
 
     @property
-    def recent_releases_count(self):
+    def visibility(self) -> str:
+        """One of public, private or internal."""
         raise NotImplementedError
 
     @property
-    def updated_issues_count(self):
+    def fork_count(self) -> int:
+        """Number of direct forks."""
         raise NotImplementedError
 
     @property
-    def closed_issues_count(self):
+    def network_size(self) -> int:
+        """Number of forks in the whole fork network of the repository."""
         raise NotImplementedError
 
     @property
-    def comment_frequency(self):
+    def org_count(self) -> int:
+        """Number of distinct organizations of the top contributors."""
+        raise NotImplementedError
+
+    @property
+    def commit_frequency(self) -> float:
+        """Average number of commits per week in the activity window, a year
+        by default."""
+        raise NotImplementedError
+
+    def get_weekly_commit_counts(self):
+        """Return commit counts for each week of the last year."""
+        raise NotImplementedError
+
+    @property
+    def active_weeks_count(self) -> int:
+        """Number of weeks in the last year with a commit."""
+        return sum(1 for count in self.get_weekly_commit_counts() if count)
+
+    @property
+    def commit_count_1y(self) -> int:
+        """Number of commits in the last year."""
+        return sum(self.get_weekly_commit_counts())
+
+    @property
+    def committer_count_1y(self) -> int:
+        """Count of distinct commit authors in the last year, or None if
+        there were no commits."""
+        raise NotImplementedError
+
+    def get_commit_verifications(self):
+        """Return whether each of the last SIGNED_COMMIT_SAMPLE_SIZE commits
+        in the last SIGNED_COMMIT_LOOKBACK_DAYS days has a verified
+        signature, or None if unavailable."""
+        raise NotImplementedError
+
+    @property
+    def signed_commit_fraction(self) -> float:
+        """Fraction of recent commits with a verified signature, or None if
+        unavailable or there are too few recent commits."""
+        verifications = self.get_commit_verifications()
+        if verifications is None or len(
+                verifications) < SIGNED_COMMIT_MIN_COUNT:
+            return None
+        return round(sum(verifications) / len(verifications), 2)
+
+    @property
+    def recent_releases_count(self) -> int:
+        """Number of releases in the activity window, a year by default,
+        estimated from tags if there are no releases."""
+        raise NotImplementedError
+
+    @property
+    def updated_issues_count(self) -> int:
+        """Number of issues updated in the issue activity window, 90 days by
+        default."""
+        raise NotImplementedError
+
+    @property
+    def closed_issues_count(self) -> int:
+        """Number of closed issues updated in the issue activity window, 90
+        days by default."""
+        raise NotImplementedError
+
+    @property
+    def comment_frequency(self) -> float:
+        """Average number of comments per issue updated in the issue activity
+        window."""
+        raise NotImplementedError
+
+    @property
+    def open_pr_count(self) -> int:
+        """Number of open pull requests (merge requests on GitLab)."""
+        raise NotImplementedError
+
+    def get_stale_pr_count(self):
+        """Return count of open pull requests without activity in the stale
+        window, STALE_PR_DAYS days unless set with set_activity_filter."""
+        raise NotImplementedError
+
+    @property
+    def stale_pr_fraction(self) -> float:
+        """Fraction of open pull requests without activity in the stale
+        window, or None if there are none."""
+        open_pr_count = self.open_pr_count
+        if not open_pr_count:
+            return None
+        return round(self.get_stale_pr_count() / open_pr_count, 2)
+
+    def get_open_labeled_issue_count(self, label):
+        """Return count of open issues with the label, or None if the
+        repository has no such label."""
+        raise NotImplementedError
+
+    @staticmethod
+    def _get_issues_since_time():
+        """Return the start of the issue activity window."""
+        return datetime.datetime.utcnow() - datetime.timedelta(
+            days=_ACTIVITY_FILTER['issue_lookback_days'] or
+            get_activity_window_days(ISSUE_LOOKBACK_DAYS))
+
+    @staticmethod
+    def _get_commit_window_weeks():
+        """Return the number of weeks commit_frequency averages over, which
+        cannot exceed the year of weekly stats GitHub keeps."""
+        return max(1, min(52, get_activity_window_days(364) // 7))
+
+    @property
+    def good_first_issue_count(self) -> int:
+        """Number of open issues labeled good first issue, or None if the
+        repository has no such label."""
+        return self.get_open_labeled_issue_count(GOOD_FIRST_ISSUE_LABEL)
+
+    @property
+    def help_wanted_count(self) -> int:
+        """Number of open issues labeled help wanted, or None if the
+        repository has no such label."""
+        return self.get_open_labeled_issue_count(HELP_WANTED_LABEL)
+
+    def get_file_paths(self):
+        """Return paths of files on the default branch, capped at
+        MAX_TREE_ENTRIES, or None if unavailable."""
+        raise NotImplementedError
+
+    @property
+    def binary_artifact_count(self) -> int:
+        """Number of binary files, e.g. executables and archives, in the
+        repository files, or None if unavailable."""
+        file_paths = self.get_file_paths()
+        if file_paths is None:
+            return None
+        return sum(1 for path in file_paths
+                   if path.lower().endswith(BINARY_ARTIFACT_EXTENSIONS))
+
+    @property
+    def has_vendored_deps(self) -> bool:
+        """Whether the repository files include a vendored dependencies
+        directory, or None if unavailable."""
+        file_paths = self.get_file_paths()
+        if file_paths is None:
+            return None
+        return any(
+            set(path.split('/')[:-1]) & VENDORED_DIRECTORIES
+            for path in file_paths)
+
+    def get_test_file_counts(self):
+        """Return (test file count, other source file count) on the default
+        branch, or None if no source files are found. Test files are guessed
+        from their names and directories, so tests kept in unusual places are
+        counted as source and fixtures with a source extension as tests."""
+        file_paths = self.get_file_paths()
+        if not file_paths:
+            return None
+        test_count = 0
+        source_count = 0
+        for path in file_paths:
+            path = path.lower()
+            if not path.endswith(SOURCE_FILE_EXTENSIONS):
+                continue
+            directories = path.split('/')[:-1]
+            file_name = path.split('/')[-1]
+            if (file_name.startswith(TEST_FILE_PREFIXES) or
+                    file_name.endswith(TEST_FILE_SUFFIXES) or
+                    set(directories) & TEST_DIRECTORIES):
+                test_count += 1
+            else:
+                source_count += 1
+        if not test_count and not source_count:
+            return None
+        return test_count, source_count
+
+    @property
+    def test_file_count(self) -> int:
+        """Number of source files that look like tests, or None if there are no
+        source files."""
+        counts = self.get_test_file_counts()
+        if counts is None:
+            return None
+        return counts[0]
+
+    @property
+    def test_to_source_ratio(self) -> float:
+        """Ratio of test files to other source files, or None if there are
+        no other source files."""
+        counts = self.get_test_file_counts()
+        if counts is None or not counts[1]:
+            return None
+        return round(counts[0] / counts[1], 2)
+
+    @property
+    def has_ci(self) -> bool:
+        """Whether the repository has a CI configuration."""
+        return bool(self.workflow_count)
+
+    @property
+    def workflow_count(self) -> int:
+        """Number of GitHub Actions workflows, or 1 if GitLab CI is
+        configured."""
+        raise NotImplementedError
+
+    @property
+    def default_branch(self) -> str:
+        """Name of the default branch."""
+        # Both GitHub and GitLab report it under the same name.
+        return self._repo.default_branch
+
+    @property
+    def default_branch_protected(self) -> bool:
+        """Whether the default branch is protected, or None if the token
+        cannot read branch protection."""
+        raise NotImplementedError
+
+    def get_topics(self):
         raise NotImplementedError
 
+    @property
+    def has_contributing(self) -> bool:
+        """Whether the repository has a contributing guide."""
+        raise NotImplementedError
+
+    @property
+    def repo_size_kb(self) -> int:
+        """Size of the repository in kilobytes, or None if unavailable."""
+        raise NotImplementedError
+
+    @property
+    def loc_estimate(self) -> int:
+        """Rough lines of code estimate derived from language byte counts."""
+        raise NotImplementedError
+
+    @property
+    def has_code_of_conduct(self) -> bool:
+        """Whether the repository has a code of conduct."""
+        raise NotImplementedError
+
+    @property
+    def topics(self) -> str:
+        """Comma separated topics, or None if there are none."""
+        # Topics are lowercase alphanumerics and hyphens, so a comma never
+        # appears inside a topic.
+        return ','.join(self.get_topics()) or None
+
+    @property
+    def topic_count(self) -> int:
+        """Number of topics."""
+        return len(self.get_topics())
+
+    @property
+    def license(self) -> str:
+        """SPDX id of the detected license, NOASSERTION if a license was found
+        but not recognized, or None if no license was found."""
+        raise NotImplementedError
+
+    @property
+    def has_osi_approved_license(self) -> bool:
+        """Whether the license is OSI approved, or None if no license was
+        found."""
+        spdx_id = self.license
+        if not spdx_id:
+            return None
+        return spdx_id in OSI_APPROVED_LICENSES
+
+    def get_dependency_graph_dependents(self):
+        """Return (repository, package) dependent counts from the dependency
+        graph, or None if unavailable."""
+        raise NotImplementedError
+
+    @property
+    def github_dependent_repo_count(self) -> int:
+        """Number of repositories depending on this one in the GitHub
+        dependency graph, or None if unavailable."""
+        dependents = self.get_dependency_graph_dependents()
+        return dependents[0] if dependents else None
+
+    @property
+    def github_dependent_package_count(self) -> int:
+        """Number of packages depending on this one in the GitHub
+        dependency graph, or None if unavailable."""
+        dependents = self.get_dependency_graph_dependents()
+        return dependents[1] if dependents else None
+
+    @property
+    def redirected_from(self) -> str:
+        """Url the repository was requested with, if it has since moved."""
+        return self._redirected_from
+
+    @property
+    def ref(self) -> str:
+        """Branch, tag or commit the file based params were pinned to."""
+        return self._ref
+
+    def _get_tree_ref(self):
+        """Return the ref to read files at, the pinned one or the default
+        branch."""
+        return self._ref or self._repo.default_branch
+
     def _request_url_with_auth_headers(self, url):
         headers = {}
-        if 'github.com' in url and _CACHED_GITHUB_TOKEN:
-            headers = {'Authorization': f'token {_CACHED_GITHUB_TOKEN}'}
+        token = self._github_token or _CACHED_GITHUB_TOKEN
+        if 'github.com' in url and token:
+            headers = {'Authorization': f'token {token}'}
 
         return requests.get(url, headers=headers)
 
+    def _request_url_with_retries(self, url):
+        """Return the response for url, retrying server errors and rate limits
+        with backoff. Other failures, e.g. 404, are returned right away."""
+        result = None
+        for i in range(FAIL_RETRIES):
+            result = self._request_url_with_auth_headers(url)
+            if not is_retryable_response(result):
+                break
+            time.sleep(2**i)
+        return result
+
     @property
-    def dependents_count(self):
+    def dependents_count(self) -> int:
+        """Number of commits across GitHub mentioning the repository, a proxy
+        for its dependents."""
         # TODO: Take package manager dependency trees into account. If we decide
         # to replace this, then find a solution for C/C++ as well.
         match = None
@@ -126,12 +535,9 @@ class Repository:
         repo_name = parsed_url.path.strip('/')
         dependents_url = (
             f'https://github.com/search?q="{repo_name}"&type=commits')
-        for i in range(FAIL_RETRIES):
-            result = self._request_url_with_auth_headers(dependents_url)
-            if result.status_code == 200:
-                match = DEPENDENTS_REGEX.match(result.content)
-                break
-            time.sleep(2**i)
+        result = self._request_url_with_retries(dependents_url)
+        if result.status_code == 200:
+            match = DEPENDENTS_REGEX.match(result.content)
         if not match:
             return 0
         return int(match.group(1).replace(b',', b''))
@@ -154,7 +560,11 @@ class GitHubRepository(Repository):
 
     @property
     def description(self):
-        return self._repo.description
+        return self._repo.description or None
+
+    @property
+    def homepage(self):
+        return self._repo.homepage or None
 
     @property
     def last_commit(self):
@@ -179,20 +589,17 @@ class GitHubRepository(Repository):
                     links[match.group(2)] = match.group(1)
             return links
 
-        for i in range(FAIL_RETRIES):
-            result = self._request_url_with_auth_headers(
-                f'{self._repo.url}/commits')
-            links = _parse_links(result)
-            if links and links.get('last'):
-                result = self._request_url_with_auth_headers(links['last'])
-            if result.status_code == 200:
-                commits = json.loads(result.content)
-                if commits:
-                    last_commit_time_string = (
-                        commits[-1]['commit']['committer']['date'])
-                    return datetime.datetime.strptime(last_commit_time_string,
-                                                      "%Y-%m-%dT%H:%M:%SZ")
-            time.sleep(2**i)
+        result = self._request_url_with_retries(f'{self._repo.url}/commits')
+        links = _parse_links(result)
+        if links and links.get('last'):
+            result = self._request_url_with_retries(links['last'])
+        if result.status_code == 200:
+            commits = json.loads(result.content)
+            if commits:
+                last_commit_time_string = (
+                    commits[-1]['commit']['committer']['date'])
+                return datetime.datetime.strptime(last_commit_time_string,
+                                                  "%Y-%m-%dT%H:%M:%SZ")
 
         return None
 
@@ -223,6 +630,12 @@ class GitHubRepository(Repository):
         difference = datetime.datetime.utcnow() - last_commit_time
         return round(difference.days / 30)
 
+    @property
+    def repo_age_days(self):
+        # PyGithub returns naive datetimes in UTC.
+        difference = datetime.datetime.utcnow() - self._repo.created_at
+        return difference.days
+
     @property
     def contributor_count(self):
         try:
@@ -235,6 +648,27 @@ class GitHubRepository(Repository):
     def watchers_count(self):
         return self._repo.watchers_count
 
+    @property
+    def subscriber_count(self):
+        return self._repo.subscribers_count
+
+    @property
+    def visibility(self):
+        # Older GitHub Enterprise versions do not report visibility.
+        visibility = self._repo.raw_data.get('visibility')
+        if visibility:
+            return visibility
+        return 'private' if self._repo.private else 'public'
+
+    @property
+    def fork_count(self):
+        return self._repo.forks_count
+
+    @property
+    def network_size(self):
+        # Only included when the token can read the full repository.
+        return self._repo.raw_data.get('network_count')
+
     @property
     def org_count(self):
         def _filter_name(org_name):
@@ -254,17 +688,73 @@ class GitHubRepository(Repository):
 
     @property
     def commit_frequency(self):
-        total = 0
-        for week_stat in self._repo.get_stats_commit_activity():
-            total += week_stat.total
-        return round(total / 52, 1)
+        # A scored param must not silently fall back to 0, so this fails with
+        # a retryable error while the stats are not ready.
+        weekly_commit_counts = self.get_weekly_commit_counts()
+        weeks = self._get_commit_window_weeks()
+        return round(sum(weekly_commit_counts[-weeks:]) / weeks, 1)
+
+    @_cached
+    def get_weekly_commit_counts(self):
+        # Raises a retryable CollectionError if GitHub is still computing the
+        # stats, which is not cached, so a retry asks again.
+        for i in range(FAIL_RETRIES):
+            # GitHub returns 202 (None here) while it computes the stats.
+            commit_activity = self._repo.get_stats_commit_activity()
+            if commit_activity is not None:
+                return [week_stat.total for week_stat in commit_activity]
+            time.sleep(2**i)
+        raise CollectionError(
+            f'Commit activity stats are not ready yet: {self.url}',
+            retryable=True)
+
+    @property
+    def committer_count_1y(self):
+        # Contributor stats only cover the top 100 contributors, which is
+        # enough to gauge maintenance breadth without paging all commits.
+        since_time = datetime.datetime.utcnow() - datetime.timedelta(weeks=52)
+        for i in range(FAIL_RETRIES):
+            # GitHub returns 202 (None here) while it computes the stats.
+            contributor_stats = self._repo.get_stats_contributors()
+            if contributor_stats is not None:
+                return sum(
+                    1 for stats in contributor_stats if any(
+                        week.c for week in stats.weeks
+                        if week.w >= since_time)) or None
+            time.sleep(2**i)
+        raise CollectionError(
+            f'Contributor stats are not ready yet: {self.url}', retryable=True)
+
+    def get_commit_verifications(self):
+        # A single GraphQL request, the REST api needs one per commit.
+        commits_since_time = datetime.datetime.utcnow() - datetime.timedelta(
+            days=SIGNED_COMMIT_LOOKBACK_DAYS)
+        owner, name = self._repo.full_name.split('/')
+        variables = {
+            'owner': owner,
+            'name': name,
+            'since': commits_since_time.isoformat() + 'Z',
+            'count': SIGNED_COMMIT_SAMPLE_SIZE,
+        }
+        data = get_github_graphql_result(GITHUB_COMMIT_SIGNATURES_QUERY,
+                                         variables,
+                                         token=self._github_token)
+        branch = data['repository']['defaultBranchRef']
+        if not branch:
+            # Empty repository.
+            return []
+        return [
+            bool(node['signature'] and node['signature']['isValid'])
+            for node in branch['target']['history']['nodes']
+        ]
 
     @property
     def recent_releases_count(self):
+        lookback_days = get_activity_window_days(RELEASE_LOOKBACK_DAYS)
         total = 0
         for release in self._repo.get_releases():
             if (datetime.datetime.utcnow() -
-                    release.created_at).days > RELEASE_LOOKBACK_DAYS:
+                    release.created_at).days > lookback_days:
                 continue
             total += 1
         if not total:
@@ -281,28 +771,43 @@ class GitHubRepository(Repository):
                 # Very large number of tags, i.e. 5000+. Cap at 26.
                 logger.error(f'get_tags is failed: {self._repo.url}')
                 return RECENT_RELEASES_THRESHOLD
-            total = round(
-                (total_tags / days_since_creation) * RELEASE_LOOKBACK_DAYS)
+            total = round((total_tags / days_since_creation) * lookback_days)
         return total
 
+    def _get_labeled_issue_activity_count(self, state):
+        """Return count of issues updated in the activity window, filtered by
+        state and the configured labels, through the issue search."""
+        query = (f'repo:{self._repo.full_name} updated:>='
+                 f'{self._get_issues_since_time().date().isoformat()}')
+        if state != 'all':
+            query += f' is:{state}'
+        for label in _ACTIVITY_FILTER['include_labels']:
+            query += f' label:"{label}"'
+        for label in _ACTIVITY_FILTER['exclude_labels']:
+            query += f' -label:"{label}"'
+        return self._get_search_issues_count(query)
+
     @property
     def updated_issues_count(self):
-        issues_since_time = datetime.datetime.utcnow() - datetime.timedelta(
-            days=ISSUE_LOOKBACK_DAYS)
+        if (_ACTIVITY_FILTER['include_labels'] or
+                _ACTIVITY_FILTER['exclude_labels']):
+            return self._get_labeled_issue_activity_count('all')
+        issues_since_time = self._get_issues_since_time()
         return self._repo.get_issues(state='all',
                                      since=issues_since_time).totalCount
 
     @property
     def closed_issues_count(self):
-        issues_since_time = datetime.datetime.utcnow() - datetime.timedelta(
-            days=ISSUE_LOOKBACK_DAYS)
+        if (_ACTIVITY_FILTER['include_labels'] or
+                _ACTIVITY_FILTER['exclude_labels']):
+            return self._get_labeled_issue_activity_count('closed')
+        issues_since_time = self._get_issues_since_time()
         return self._repo.get_issues(state='closed',
                                      since=issues_since_time).totalCount
 
     @property
     def comment_frequency(self):
-        issues_since_time = datetime.datetime.utcnow() - datetime.timedelta(
-            days=ISSUE_LOOKBACK_DAYS)
+        issues_since_time = self._get_issues_since_time()
         issue_count = self._repo.get_issues(state='all',
                                             since=issues_since_time).totalCount
         if not issue_count:
@@ -311,6 +816,158 @@ class GitHubRepository(Repository):
             since=issues_since_time).totalCount
         return round(comment_count / issue_count, 1)
 
+    @property
+    def open_pr_count(self):
+        return self._repo.get_pulls(state='open').totalCount
+
+    def get_stale_pr_count(self):
+        stale_since_time = datetime.datetime.utcnow() - datetime.timedelta(
+            days=_ACTIVITY_FILTER['stale_pr_days'])
+        stale_since_date = stale_since_time.date()
+        query = (f'repo:{self._repo.full_name} is:pr is:open '
+                 f'updated:<{stale_since_date.isoformat()}')
+        return self._get_search_issues_count(query)
+
+    def get_open_labeled_issue_count(self, label):
+        try:
+            self._repo.get_label(label)
+        except github.GithubException as exp:
+            if exp.status == 404:
+                return None
+            raise
+        query = (f'repo:{self._repo.full_name} is:issue is:open '
+                 f'label:"{label}"')
+        return self._get_search_issues_count(query)
+
+    def _get_search_issues_count(self, query):
+        """Return the total count of issues and pull requests matching an
+        issue search query."""
+        result = self._request_url_with_retries(
+            f'{GITHUB_API_URL}/search/issues?'
+            f'q={urllib.parse.quote_plus(query)}&per_page=1')
+        if result.status_code != 200:
+            # Counting 0 would silently lower issue activity.
+            raise CollectionError(
+                f'Issue search failed with status {result.status_code}: '
+                f'{self.url}',
+                retryable=is_retryable_response(result))
+        return json.loads(result.content)['total_count']
+
+    @_cached
+    def get_file_paths(self):
+        try:
+            tree = self._repo.get_git_tree(self._get_tree_ref(),
+                                           recursive=True)
+        except github.GithubException as exp:
+            if is_retryable_error(exp):
+                raise
+            # Empty repository or missing default branch.
+            return None
+        # GitHub truncates the tree of very large repositories.
+        file_paths = [e.path for e in tree.tree if e.type == 'blob']
+        return file_paths[:MAX_TREE_ENTRIES]
+
+    def _get_subtree(self, path):
+        """Return git tree entries for a directory at the tree ref."""
+        try:
+            tree = self._repo.get_git_tree(self._get_tree_ref())
+            for part in path.split('/'):
+                entry = next((e for e in tree.tree
+                              if e.path == part and e.type == 'tree'), None)
+                if not entry:
+                    return []
+                tree = self._repo.get_git_tree(entry.sha)
+        except github.GithubException as exp:
+            if is_retryable_error(exp):
+                raise
+            # Empty repository or missing default branch.
+            return []
+        return tree.tree
+
+    @_cached
+    def get_topics(self):
+        return self._repo.get_topics()
+
+    @property
+    def repo_size_kb(self):
+        return self._repo.size
+
+    @property
+    def license(self):
+        license_info = self._repo.raw_data.get('license')
+        if not license_info:
+            return None
+        return license_info.get('spdx_id')
+
+    @_cached
+    def get_dependency_graph_dependents(self):
+        # The dependents counts are not exposed in the REST or GraphQL apis,
+        # so read them from the "Used by" page.
+        result = self._request_url_with_retries(
+            f'{self._repo.html_url}/network/dependents')
+        if result.status_code != 200:
+            raise CollectionError(
+                f'Dependents page failed with status {result.status_code}: '
+                f'{self.url}',
+                retryable=is_retryable_response(result))
+        repo_match = DEPENDENT_REPOS_REGEX.search(result.content)
+        package_match = DEPENDENT_PACKAGES_REGEX.search(result.content)
+        if not repo_match or not package_match:
+            # Dependency graph is disabled for this repository.
+            return None
+        return (int(repo_match.group(1).replace(b',', b'')),
+                int(package_match.group(1).replace(b',', b'')))
+
+    @property
+    def loc_estimate(self):
+        try:
+            languages = self._repo.get_languages()
+        except github.GithubException as exp:
+            if is_retryable_error(exp):
+                raise
+            return None
+        if not languages:
+            return None
+        return round(sum(languages.values()) / BYTES_PER_LINE_ESTIMATE)
+
+    @_cached
+    def _get_community_profile_files(self):
+        """Return the files section of the repository community profile."""
+        result = self._request_url_with_retries(
+            f'{self._repo.url}/community/profile')
+        if result.status_code != 200:
+            # Reporting the files as missing would be wrong.
+            raise CollectionError(
+                f'Community profile failed with status {result.status_code}: '
+                f'{self.url}',
+                retryable=is_retryable_response(result))
+        return json.loads(result.content).get('files') or {}
+
+    @property
+    def has_contributing(self):
+        return bool(self._get_community_profile_files().get('contributing'))
+
+    @property
+    def has_code_of_conduct(self):
+        return bool(
+            self._get_community_profile_files().get('code_of_conduct'))
+
+    @property
+    def default_branch_protected(self):
+        try:
+            return self._repo.get_branch(self._repo.default_branch).protected
+        except github.GithubException as exp:
+            if is_retryable_error(exp):
+                raise
+            logger.debug(
+                f'Unable to read branch protection: {self._repo.url}\n{exp}')
+            return None
+
+    @property
+    def workflow_count(self):
+        return sum(1 for e in self._get_subtree(GITHUB_WORKFLOWS_PATH)
+                   if e.type == 'blob' and e.path.endswith(('.yml', '.yaml')))
+
 
 class GitLabRepository(Repository):
     """Source repository hosted on GitLab."""
@@ -327,6 +984,15 @@ class GitLabRepository(Repository):
     def url(self):
         return self._repo.web_url
 
+    @property
+    def description(self):
+        return self._repo.description or None
+
+    @property
+    def homepage(self):
+        # GitLab projects have no homepage field.
+        return None
+
     @property
     def language(self):
         languages = self._repo.languages()
@@ -359,32 +1025,133 @@ class GitLabRepository(Repository):
                 self.last_commit.created_at)
         return round(difference.days / 30)
 
+    @property
+    def repo_age_days(self):
+        difference = datetime.datetime.now(
+            datetime.timezone.utc) - self._date_from_string(
+                self._repo.created_at)
+        return difference.days
+
     @property
     def contributor_count(self):
         return len(self._repo.repository_contributors(all=True))
 
+    @property
+    def watchers_count(self):
+        return self._repo.star_count
+
+    @property
+    def subscriber_count(self):
+        # GitLab does not expose who is watching a project.
+        return None
+
+    @property
+    def visibility(self):
+        return self._repo.visibility
+
+    @property
+    def fork_count(self):
+        return self._repo.forks_count
+
+    @property
+    def network_size(self):
+        # GitLab has no fork network counts.
+        return None
+
     @property
     def org_count(self):
         # Not possible to calculate as this feature restricted to admins only.
         # https://docs.gitlab.com/ee/api/users.html#user-memberships-admin-only
         return 1
 
+    @_cached
+    def _get_commits_1y(self):
+        """Return the commits of the last 52 weeks, which several params page
+        through."""
+        commits_since_time = datetime.datetime.utcnow() - datetime.timedelta(
+            weeks=52)
+        return list(
+            self._repo.commits.list(since=commits_since_time, as_list=False))
+
     @property
     def commit_frequency(self):
-        commits_since_time = datetime.datetime.utcnow() - datetime.timedelta(
-            days=365)
-        iterator = self._repo.commits.list(since=commits_since_time,
-                                           as_list=False)
-        commits_count = sum(1 for _ in iterator)
-        return round(commits_count / 52, 1)
+        weeks = self._get_commit_window_weeks()
+        since_time = datetime.datetime.now(
+            datetime.timezone.utc) - datetime.timedelta(weeks=weeks)
+        commits_count = sum(
+            1 for commit in self._get_commits_1y()
+            if self._date_from_string(commit.created_at) >= since_time)
+        return round(commits_count / weeks, 1)
+
+    @property
+    def open_pr_count(self):
+        return self._repo.mergerequests.list(state='opened',
+                                             as_list=False).total
+
+    def get_stale_pr_count(self):
+        stale_since_time = datetime.datetime.utcnow() - datetime.timedelta(
+            days=_ACTIVITY_FILTER['stale_pr_days'])
+        return self._repo.mergerequests.list(state='opened',
+                                             updated_before=stale_since_time,
+                                             as_list=False).total
+
+    def get_open_labeled_issue_count(self, label):
+        try:
+            self._repo.labels.get(label)
+        except gitlab.exceptions.GitlabGetError as exp:
+            if exp.response_code == 404:
+                return None
+            raise
+        return self._repo.issues.list(state='opened',
+                                      labels=[label],
+                                      as_list=False).total
+
+    @_cached
+    def get_file_paths(self):
+        file_paths = []
+        try:
+            for entry in self._repo.repository_tree(
+                    ref=self._get_tree_ref(),
+                    recursive=True,
+                    as_list=False):
+                if entry['type'] == 'blob':
+                    file_paths.append(entry['path'])
+                if len(file_paths) >= MAX_TREE_ENTRIES:
+                    break
+        except gitlab.exceptions.GitlabGetError as exp:
+            if exp.response_code != 404:
+                raise
+            # Empty repository.
+            return None
+        return file_paths
+
+    def get_weekly_commit_counts(self):
+        now = datetime.datetime.now(datetime.timezone.utc)
+        weekly_commit_counts = [0] * 52
+        for commit in self._get_commits_1y():
+            week = (now - self._date_from_string(commit.created_at)).days // 7
+            if week < 52:
+                weekly_commit_counts[51 - week] += 1
+        return weekly_commit_counts
+
+    @property
+    def committer_count_1y(self):
+        return len({commit.author_email
+                    for commit in self._get_commits_1y()}) or None
+
+    def get_commit_verifications(self):
+        # GitLab only reports signatures one commit at a time, which costs too
+        # many requests per repository.
+        return None
 
     @property
     def recent_releases_count(self):
+        lookback_days = get_activity_window_days(RELEASE_LOOKBACK_DAYS)
         count = 0
         for release in self._repo.releases.list():
             release_time = self._date_from_string(release.released_at)
             if (datetime.datetime.now(datetime.timezone.utc) -
-                    release_time).days > RELEASE_LOOKBACK_DAYS:
+                    release_time).days > lookback_days:
                 break
             count += 1
         count = 0
@@ -392,37 +1159,107 @@ class GitLabRepository(Repository):
             for tag in self._repo.tags.list():
                 tag_time = self._date_from_string(tag.commit['created_at'])
                 if (datetime.datetime.now(datetime.timezone.utc) -
-                        tag_time).days > RELEASE_LOOKBACK_DAYS:
+                        tag_time).days > lookback_days:
                     break
                 count += 1
         return count
 
+    def _get_issue_filter_kwargs(self):
+        """Return issue list arguments for the activity window and the
+        configured labels."""
+        kwargs = {'updated_after': self._get_issues_since_time()}
+        if _ACTIVITY_FILTER['include_labels']:
+            kwargs['labels'] = ','.join(_ACTIVITY_FILTER['include_labels'])
+        if _ACTIVITY_FILTER['exclude_labels']:
+            kwargs['not[labels]'] = ','.join(_ACTIVITY_FILTER['exclude_labels'])
+        return kwargs
+
     @property
     def updated_issues_count(self):
-        issues_since_time = datetime.datetime.utcnow() - datetime.timedelta(
-            days=ISSUE_LOOKBACK_DAYS)
         return self._repo.issuesstatistics.get(
-            updated_after=issues_since_time).statistics['counts']['all']
+            **self._get_issue_filter_kwargs()).statistics['counts']['all']
 
     @property
     def closed_issues_count(self):
-        issues_since_time = datetime.datetime.utcnow() - datetime.timedelta(
-            days=ISSUE_LOOKBACK_DAYS)
         return self._repo.issuesstatistics.get(
-            updated_after=issues_since_time).statistics['counts']['closed']
+            **self._get_issue_filter_kwargs()).statistics['counts']['closed']
 
     @property
     def comment_frequency(self):
+        issues_count = 0
         comments_count = 0
-        issues_since_time = datetime.datetime.utcnow() - datetime.timedelta(
-            days=ISSUE_LOOKBACK_DAYS)
-        for issue in self._repo.issues.list(updated_after=issues_since_time,
-                                            as_list=False):
+        for issue in self._repo.issues.list(as_list=False,
+                                            **self._get_issue_filter_kwargs()):
+            issues_count += 1
             try:
                 comments_count += issue.notes.list(as_list=False).total
             except Exception:
                 pass
-        return round(comments_count / self.updated_issues_count, 1)
+        if not issues_count:
+            return 0
+        return round(comments_count / issues_count, 1)
+
+    def _has_file(self, file_path):
+        try:
+            self._repo.files.get(file_path=file_path,
+                                 ref=self._get_tree_ref())
+        except gitlab.exceptions.GitlabGetError as exp:
+            if exp.response_code != 404:
+                raise
+            return False
+        return True
+
+    @property
+    def has_contributing(self):
+        return self._has_file(CONTRIBUTING_PATH)
+
+    @property
+    def repo_size_kb(self):
+        # Only present when the project is fetched with statistics.
+        statistics = getattr(self._repo, 'statistics', None)
+        if not statistics:
+            return None
+        return round(statistics['repository_size'] / 1024)
+
+    @property
+    def loc_estimate(self):
+        # GitLab only reports language percentages, not byte counts.
+        return None
+
+    def get_dependency_graph_dependents(self):
+        return None
+
+    @property
+    def license(self):
+        # GitLab does not report SPDX ids.
+        return None
+
+    @property
+    def has_code_of_conduct(self):
+        return self._has_file(CODE_OF_CONDUCT_PATH)
+
+    def get_topics(self):
+        # Older GitLab versions only expose topics as tag_list.
+        return (getattr(self._repo, 'topics', None) or
+                getattr(self._repo, 'tag_list', None) or [])
+
+    @property
+    def default_branch_protected(self):
+        try:
+            self._repo.protectedbranches.get(self._repo.default_branch)
+        except gitlab.exceptions.GitlabGetError as exp:
+            if exp.response_code == 404:
+                return False
+            if is_retryable_error(exp):
+                raise
+            logger.debug(f'Unable to read branch protection: '
+                         f'{self._repo.web_url}\n{exp}')
+            return None
+        return True
+
+    @property
+    def workflow_count(self):
+        return int(self._has_file(GITLAB_CI_CONFIG_PATH))
 
 
 def get_param_score(param, max_value, weight=1):
@@ -431,17 +1268,70 @@ def get_param_score(param, max_value, weight=1):
     return (math.log(1 + param) / math.log(1 + max(param, max_value))) * weight
 
 
-def get_repository_stats(repo, additional_params=None):
-    """Return repository stats, including criticality score."""
-    # Validate and compute additional params first.
-    if not repo.last_commit:
-        logger.error(f'Repo is empty: {repo.url}')
-        return None
-    if additional_params is None:
-        additional_params = []
+def is_github_secondary_rate_limit_error(exp):
+    """Return whether a GitHub error is a secondary (abuse) rate limit."""
+    if exp.status != 403:
+        return False
+    message = str((exp.data or {}).get('message', '')).lower()
+    return 'secondary rate limit' in message or 'abuse' in message
+
+
+def is_github_rate_limit_error(exp):
+    """Return whether a GitHub error is an exhausted primary rate limit."""
+    if isinstance(exp, github.RateLimitExceededException):
+        return True
+    if exp.status != 403:
+        return False
+    headers = exp.headers or {}
+    message = str((exp.data or {}).get('message', '')).lower()
+    return (headers.get('x-ratelimit-remaining') == '0' or
+            'api rate limit exceeded' in message)
+
+
+class CollectionError(Exception):
+    """Collecting repository stats failed.
+
+    retryable tells whether trying again later is likely to succeed, e.g.
+    after a server error or rate limit, as opposed to a missing resource."""
+
+    def __init__(self, message, retryable=False):
+        super().__init__(message)
+        self.retryable = retryable
+
+
+def is_retryable_response(response):
+    """Return whether a failed http response is likely transient, i.e. a
+    server error or rate limit."""
+    if response.status_code >= 500 or response.status_code == 429:
+        return True
+    # GitHub reports exhausted primary and secondary rate limits as 403.
+    return response.status_code == 403 and (
+        response.headers.get('X-RateLimit-Remaining') == '0' or
+        'rate limit' in response.text.lower())
+
+
+def is_retryable_error(exp):
+    """Return whether an error computing a param is likely transient."""
+    if isinstance(exp, CollectionError):
+        return exp.retryable
+    if isinstance(exp, (requests.exceptions.ConnectionError,
+                        requests.exceptions.Timeout)):
+        return True
+    if isinstance(exp, github.GithubException):
+        return (exp.status >= 500 or is_github_rate_limit_error(exp) or
+                is_github_secondary_rate_limit_error(exp))
+    if isinstance(exp, gitlab.exceptions.GitlabError):
+        return ((exp.response_code or 0) >= 500 or
+                exp.response_code == 429)
+    return False
+
+
+def get_additional_params_score(additional_params):
+    """Return (score, total weight) for additional params given in form
+    <value>:<weight>:<max_threshold>."""
     additional_params_total_weight = 0
     additional_params_score = 0
-    for additional_param in additional_params:
+    for additional_param in additional_params or []:
         try:
             value, weight, max_threshold = [
                 int(i) for i in additional_param.split(':')
@@ -452,20 +1342,143 @@ def get_repository_stats(repo, additional_params=None):
         additional_params_total_weight += weight
         additional_params_score += get_param_score(value, max_threshold,
                                                    weight)
+    return additional_params_score, additional_params_total_weight
 
-    def _worker(repo, param, return_dict):
-        """worker function"""
-        return_dict[param] = getattr(repo, param)
 
+def get_criticality_score(stats,
+                          additional_params_score=0,
+                          additional_params_total_weight=0,
+                          precision=SCORE_PRECISION):
+    """Return criticality score given repository stats."""
+    total_weight = additional_params_total_weight
+    total_score = 0
+    for param, (weight, max_threshold) in SCORED_PARAMS.items():
+        total_weight += weight
+        total_score += get_param_score(stats[param], max_threshold, weight)
+
+    criticality_score = round(
+        (total_score + additional_params_score) / total_weight, precision)
+
+    # Make sure score between 0 (least-critical) and 1 (most-critical).
+    return max(min(criticality_score, 1), 0)
+
+
+def get_scoring_hash(additional_params=None,
+                     score_mode='threshold',
+                     score_precision=SCORE_PRECISION):
+    """Return a stable fingerprint of everything that decides a score: the
+    weights and thresholds of SCORED_PARAMS, the additional params, the score
+    mode and precision, and the activity filter."""
+    scoring_config = {
+        'scored_params': SCORED_PARAMS,
+        'additional_params': sorted(additional_params or []),
+        'score_mode': score_mode,
+        'score_precision': score_precision,
+        'activity_filter': _ACTIVITY_FILTER,
+    }
+    return hashlib.sha256(
+        json.dumps(scoring_config,
+                   sort_keys=True).encode('utf-8')).hexdigest()[:16]
+
+
+def get_normalized_param_values(stats):
+    """Return each scored param normalized to [0, 1], before weighting."""
+    return {
+        f'{param}_normalized': round(
+            get_param_score(stats[param], max_threshold), 5)
+        for param, (_, max_threshold) in SCORED_PARAMS.items()
+    }
+
+
+class DeadlineExceededError(Exception):
+    """Computing repository stats took longer than the allowed timeout."""
+
+
+def get_param_status_columns(params):
+    """Return the status columns of the unscored params among params, see
+    get_repository_stats."""
+    return [f'{param}_status' for param in params if param not in SCORED_PARAMS]
+
+
+def get_repository_stats(repo,
+                         additional_params=None,
+                         timeout=None,
+                         score_precision=SCORE_PRECISION,
+                         param_status=False):
+    """Return repository stats, including criticality score.
+
+    If timeout (in seconds) is given and computing the params takes longer,
+    the unfinished params are abandoned. If a scored param fails or times
+    out, the score cannot be computed: CollectionError is raised, telling
+    whether the failure is worth retrying, or DeadlineExceededError. An
+    unscored param that fails or times out is left empty instead. With
+    param_status, a <param>_status column of each unscored param tells ok,
+    error or timeout apart, so an empty value is not mistaken for missing
+    data."""
+    # Validate and compute additional params first.
+    if not repo.last_commit:
+        logger.error(f'Repo is empty: {repo.url}')
+        return None
+    additional_params_score, additional_params_total_weight = (
+        get_additional_params_score(additional_params))
+
+    def _worker(repo, param, return_dict, error_dict):
+        """worker function"""
+        start_time = time.time()
+        for i in range(PARAM_RETRIES):
+            try:
+                return_dict[param] = getattr(repo, param)
+                break
+            except Exception as exp:
+                if not is_retryable_error(exp) or i == PARAM_RETRIES - 1:
+                    error_dict[param] = exp
+                    return
+                logger.warning(
+                    f'Retrying {param} after error: {repo.url}\n{exp}')
+                if (isinstance(exp, github.GithubException) and
+                        is_github_secondary_rate_limit_error(exp)):
+                    time.sleep(SECONDARY_RATE_LIMIT_WAIT_SECONDS)
+                else:
+                    time.sleep(2**i)
+        duration = time.time() - start_time
+        logger.debug(f'{param} took {round(duration, 2)}s: {repo.url}')
+        with _PARAM_DURATIONS_LOCK:
+            _PARAM_DURATIONS[param].append(duration)
+
+    params = get_enabled_params()
     threads = []
     return_dict = {}
-    for param in PARAMS:
+    error_dict = {}
+    for param in params:
         thread = threading.Thread(target=_worker,
-                                  args=(repo, param, return_dict))
+                                  args=(repo, param, return_dict, error_dict),
+                                  daemon=True)
         thread.start()
         threads.append(thread)
+    deadline = time.time() + timeout if timeout else None
     for thread in threads:
-        thread.join()
+        thread.join(max(deadline - time.time(), 0) if deadline else None)
+    # Abandoned threads may still write to the dicts.
+    return_dict = dict(return_dict)
+    error_dict = dict(error_dict)
+    pending_params = [
+        param for param in params
+        if param not in return_dict and param not in error_dict
+    ]
+    if any(param in SCORED_PARAMS for param in pending_params):
+        raise DeadlineExceededError(
+            f'Timed out after {timeout}s computing {pending_params}: '
+            f'{repo.url}')
+    for param, exp in error_dict.items():
+        if param in SCORED_PARAMS:
+            raise CollectionError(f'Failed to compute {param}: {repo.url}',
+                                  retryable=is_retryable_error(exp)) from exp
+    for param, exp in error_dict.items():
+        logger.warning(
+            f'Failed to compute {param}, leaving it empty: {repo.url}\n{exp}')
+    if pending_params:
+        logger.warning(f'Timed out after {timeout}s computing '
+                       f'{pending_params}, leaving them empty: {repo.url}')
 
     # Guarantee insertion order.
     result_dict = {
@@ -473,47 +1486,149 @@ def get_repository_stats(repo, additional_params=None):
         'url': repo.url,
         'language': repo.language,
     }
-    for param in PARAMS:
-        result_dict[param] = return_dict[param]
+    for param in params:
+        result_dict[param] = return_dict.get(param)
+
+    result_dict['criticality_score'] = get_criticality_score(
+        result_dict, additional_params_score, additional_params_total_weight,
+        score_precision)
+    if param_status:
+        for param in params:
+            if param in SCORED_PARAMS:
+                continue
+            if param in error_dict:
+                status = 'error'
+            elif param in pending_params:
+                status = 'timeout'
+            else:
+                status = 'ok'
+            result_dict[f'{param}_status'] = status
+    return result_dict
 
-    total_weight = (CREATED_SINCE_WEIGHT + UPDATED_SINCE_WEIGHT +
-                    CONTRIBUTOR_COUNT_WEIGHT + ORG_COUNT_WEIGHT +
-                    COMMIT_FREQUENCY_WEIGHT + RECENT_RELEASES_WEIGHT +
-                    CLOSED_ISSUES_WEIGHT + UPDATED_ISSUES_WEIGHT +
-                    COMMENT_FREQUENCY_WEIGHT + DEPENDENTS_COUNT_WEIGHT +
-                    additional_params_total_weight)
 
-    criticality_score = round(
-        ((get_param_score(result_dict['created_since'],
-                          CREATED_SINCE_THRESHOLD, CREATED_SINCE_WEIGHT)) +
-         (get_param_score(result_dict['updated_since'],
-                          UPDATED_SINCE_THRESHOLD, UPDATED_SINCE_WEIGHT)) +
-         (get_param_score(result_dict['contributor_count'],
-                          CONTRIBUTOR_COUNT_THRESHOLD,
-                          CONTRIBUTOR_COUNT_WEIGHT)) +
-         (get_param_score(result_dict['org_count'], ORG_COUNT_THRESHOLD,
-                          ORG_COUNT_WEIGHT)) +
-         (get_param_score(result_dict['commit_frequency'],
-                          COMMIT_FREQUENCY_THRESHOLD,
-                          COMMIT_FREQUENCY_WEIGHT)) +
-         (get_param_score(result_dict['recent_releases_count'],
-                          RECENT_RELEASES_THRESHOLD, RECENT_RELEASES_WEIGHT)) +
-         (get_param_score(result_dict['closed_issues_count'],
-                          CLOSED_ISSUES_THRESHOLD, CLOSED_ISSUES_WEIGHT)) +
-         (get_param_score(result_dict['updated_issues_count'],
-                          UPDATED_ISSUES_THRESHOLD, UPDATED_ISSUES_WEIGHT)) +
-         (get_param_score(
-             result_dict['comment_frequency'], COMMENT_FREQUENCY_THRESHOLD,
-             COMMENT_FREQUENCY_WEIGHT)) + (get_param_score(
-                 result_dict['dependents_count'], DEPENDENTS_COUNT_THRESHOLD,
-                 DEPENDENTS_COUNT_WEIGHT)) + additional_params_score) /
-        total_weight, 5)
+def log_param_durations():
+    """Log p50/p90/p99 durations of computing each parameter so far."""
+    def _percentile(durations, percent):
+        return durations[min(len(durations) - 1,
+                             int(len(durations) * percent / 100))]
+
+    with _PARAM_DURATIONS_LOCK:
+        for param, durations in sorted(_PARAM_DURATIONS.items()):
+            durations = sorted(durations)
+            logger.info(f'{param} durations: '
+                        f'p50={round(_percentile(durations, 50), 2)}s '
+                        f'p90={round(_percentile(durations, 90), 2)}s '
+                        f'p99={round(_percentile(durations, 99), 2)}s')
+
+
+def set_activity_filter(include_labels=None,
+                        exclude_labels=None,
+                        issue_lookback_days=None,
+                        window_days=None,
+                        stale_pr_days=STALE_PR_DAYS):
+    """Configure which issues count as activity, and the activity windows, for
+    all repositories.
+
+    window_days replaces the default window of the activity params:
+    commit_frequency (up to a year, 52 weeks by default), recent_releases_count
+    (365 days), and updated_issues_count, closed_issues_count and
+    comment_frequency (90 days). issue_lookback_days overrides it for the
+    issue params only. Other params keep their fixed windows, e.g. the ones
+    named _1y.
+
+    The labels narrow down updated_issues_count and closed_issues_count to
+    issues with all of include_labels and none of exclude_labels; on GitLab
+    they also apply to comment_frequency. Open pull requests without activity
+    in the last stale_pr_days count as stale in stale_pr_fraction."""
+    _ACTIVITY_FILTER['include_labels'] = list(include_labels or [])
+    _ACTIVITY_FILTER['exclude_labels'] = list(exclude_labels or [])
+    _ACTIVITY_FILTER['issue_lookback_days'] = issue_lookback_days
+    _ACTIVITY_FILTER['window_days'] = window_days
+    _ACTIVITY_FILTER['stale_pr_days'] = stale_pr_days
+    if window_days or issue_lookback_days not in (None, ISSUE_LOOKBACK_DAYS):
+        logger.warning(
+            'Activity windows differ from the defaults the score thresholds '
+            'are calibrated for, so scores are not comparable to runs with '
+            'the default windows.')
+
+
+def set_extra_params(extra_params):
+    """Collect the given EXTRA_PARAMS, in addition to PARAMS, for all
+    repositories."""
+    _ENABLED_EXTRA_PARAMS[:] = [
+        param for param in EXTRA_PARAMS if param in extra_params
+    ]
+
+
+def get_enabled_params():
+    """Return PARAMS followed by the extra params enabled with
+    set_extra_params."""
+    return PARAMS + _ENABLED_EXTRA_PARAMS
+
+
+def add_extra_params_argument(parser):
+    """Add the flag configuring set_extra_params to parser."""
+    parser.add_argument(
+        '--extra-params',
+        nargs='*',
+        choices=EXTRA_PARAMS,
+        metavar='PARAM',
+        help='Also collect these unscored params, or all of them if none are '
+        'given, see --list-params. Most cost extra api requests per '
+        'repository, made concurrently, which can trigger GitHub\'s '
+        'secondary rate limits.')
 
-    # Make sure score between 0 (least-critical) and 1 (most-critical).
-    criticality_score = max(min(criticality_score, 1), 0)
 
-    result_dict['criticality_score'] = criticality_score
-    return result_dict
+def set_extra_params_from_args(args):
+    """Call set_extra_params with the flag added by
+    add_extra_params_argument."""
+    if args.extra_params is not None:
+        set_extra_params(args.extra_params or EXTRA_PARAMS)
+
+
+def get_activity_window_days(default_days):
+    """Return the window of an activity param defaulting to default_days, see
+    set_activity_filter."""
+    return _ACTIVITY_FILTER['window_days'] or default_days
+
+
+def add_activity_filter_arguments(parser):
+    """Add the flags configuring set_activity_filter to parser."""
+    parser.add_argument(
+        '--issue-include-labels',
+        nargs='+',
+        default=[],
+        help='Only count issues with all of these labels as activity.')
+    parser.add_argument(
+        '--issue-exclude-labels',
+        nargs='+',
+        default=[],
+        help='Do not count issues with any of these labels as activity.')
+    parser.add_argument(
+        '--issue-lookback-days',
+        type=int,
+        help='Number of days of issue activity to count, instead of '
+        '--activity-window-days.')
+    parser.add_argument(
+        '--activity-window-days',
+        type=int,
+        help='Number of days of activity counted by the commit, release and '
+        'issue activity params, instead of their defaults. Changes what the '
+        'score means.')
+    parser.add_argument(
+        '--stale-pr-days',
+        type=int,
+        default=STALE_PR_DAYS,
+        help='Number of days without activity after which an open pull '
+        'request counts as stale.')
+
+
+def set_activity_filter_from_args(args):
+    """Call set_activity_filter with the flags added by
+    add_activity_filter_arguments."""
+    set_activity_filter(args.issue_include_labels, args.issue_exclude_labels,
+                        args.issue_lookback_days, args.activity_window_days,
+                        args.stale_pr_days)
 
 
 def get_github_token_info(token_obj):
@@ -524,19 +1639,73 @@ def get_github_token_info(token_obj):
     return near_expiry, wait_time
 
 
+def get_github_rate_limit_budget():
+    """Return the remaining requests and hourly limit of the core rate limit,
+    summed over all GitHub tokens, and the seconds until the first of them
+    resets."""
+    remaining = 0
+    limit = 0
+    reset_seconds = None
+    for token in get_github_auth_tokens():
+        core = github.Github(token).get_rate_limit().core
+        remaining += core.remaining
+        limit += core.limit
+        wait_time = max(
+            (core.reset - datetime.datetime.utcnow()).total_seconds(), 0)
+        if reset_seconds is None or wait_time < reset_seconds:
+            reset_seconds = wait_time
+    return remaining, limit, reset_seconds
+
+
+def get_github_app_token():
+    """Return an installation token for the GitHub App configured in
+    GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and GITHUB_APP_PRIVATE_KEY_PATH,
+    minting a new one shortly before the cached one expires."""
+    global _CACHED_GITHUB_APP_TOKEN
+    if _CACHED_GITHUB_APP_TOKEN:
+        expires_at = _CACHED_GITHUB_APP_TOKEN.expires_at.replace(tzinfo=None)
+        remaining = expires_at - datetime.datetime.utcnow()
+        if remaining.total_seconds() > GITHUB_APP_TOKEN_REFRESH_SECONDS:
+            return _CACHED_GITHUB_APP_TOKEN.token
+
+    app_id = os.getenv('GITHUB_APP_ID')
+    installation_id = os.getenv('GITHUB_APP_INSTALLATION_ID')
+    private_key_path = os.getenv('GITHUB_APP_PRIVATE_KEY_PATH')
+    assert installation_id and private_key_path, (
+        'GITHUB_APP_INSTALLATION_ID and GITHUB_APP_PRIVATE_KEY_PATH need to be '
+        'set with GITHUB_APP_ID.')
+    with open(private_key_path) as file_handle:
+        private_key = file_handle.read()
+    integration = github.GithubIntegration(int(app_id), private_key)
+    _CACHED_GITHUB_APP_TOKEN = integration.get_access_token(
+        int(installation_id))
+    logger.info(f'Minted GitHub App installation token, expires at '
+                f'{_CACHED_GITHUB_APP_TOKEN.expires_at}.')
+    return _CACHED_GITHUB_APP_TOKEN.token
+
+
+def get_github_auth_tokens():
+    """Return the github tokens to rotate through, either a GitHub App
+    installation token or the ones listed in GITHUB_AUTH_TOKEN."""
+    if os.getenv('GITHUB_APP_ID'):
+        return [get_github_app_token()]
+    github_auth_token = os.getenv('GITHUB_AUTH_TOKEN')
+    assert github_auth_token, 'GITHUB_AUTH_TOKEN needs to be set.'
+    return github_auth_token.split(',')
+
+
 def get_github_auth_token():
     """Return an un-expired github token if possible from a list of tokens."""
     global _CACHED_GITHUB_TOKEN
     global _CACHED_GITHUB_TOKEN_OBJ
-    if _CACHED_GITHUB_TOKEN_OBJ:
+    tokens = get_github_auth_tokens()
+    # An app installation token is replaced before it expires, which drops the
+    # cached one from the list.
+    if _CACHED_GITHUB_TOKEN_OBJ and _CACHED_GITHUB_TOKEN in tokens:
         near_expiry, _ = get_github_token_info(_CACHED_GITHUB_TOKEN_OBJ)
         if not near_expiry:
             return _CACHED_GITHUB_TOKEN_OBJ
 
-    github_auth_token = os.getenv('GITHUB_AUTH_TOKEN')
-    assert github_auth_token, 'GITHUB_AUTH_TOKEN needs to be set.'
-    tokens = github_auth_token.split(',')
-
     min_wait_time = None
     token_obj = None
     for token in tokens:
@@ -556,6 +1725,85 @@ def get_github_auth_token():
     return token_obj
 
 
+def get_github_graphql_result(query, variables=None, token=None):
+    """Return the data of a GitHub GraphQL v4 query, using token if given or
+    else the same rotating token as the REST api."""
+    if not token:
+        # Refreshes the cached token if it is close to its rate limit.
+        get_github_auth_token()
+    headers = {'Authorization': f'token {token or _CACHED_GITHUB_TOKEN}'}
+    result = None
+    for i in range(FAIL_RETRIES):
+        result = requests.post(GITHUB_GRAPHQL_URL,
+                               json={
+                                   'query': query,
+                                   'variables': variables or {}
+                               },
+                               headers=headers)
+        retryable = is_retryable_response(result)
+        if result.status_code == 200:
+            content = json.loads(result.content)
+            errors = content.get('errors')
+            if not errors:
+                return content['data']
+            # GraphQL reports rate limits as errors of a successful response.
+            retryable = any(
+                error.get('type') == 'RATE_LIMITED' for error in errors)
+            if not retryable:
+                raise CollectionError(f'GraphQL query failed: {errors}')
+        elif not retryable:
+            break
+        time.sleep(2**i)
+        if not token:
+            get_github_auth_token()
+            headers = {'Authorization': f'token {_CACHED_GITHUB_TOKEN}'}
+    raise CollectionError(
+        f'GraphQL query failed with status {result.status_code}',
+        retryable=retryable)
+
+
+def get_github_client_token(github_client):
+    """Return the token a PyGithub client authenticates with, or None."""
+    # PyGithub keeps it private: newer versions hold an auth object, older
+    # ones the Authorization header.
+    requester = getattr(github_client, '_Github__requester', None)
+    auth = getattr(requester, '_Requester__auth', None)
+    if getattr(auth, 'token', None):
+        return auth.token
+    header = getattr(requester, '_Requester__authorizationHeader', None)
+    if header and header.startswith('token '):
+        return header[len('token '):]
+    return None
+
+
+def validate_auth_tokens(gitlab_host=GITLAB_DEFAULT_HOST):
+    """Check that every configured auth token works, and raise an exception
+    listing the ones that do not."""
+    errors = []
+    github_auth_token = os.getenv('GITHUB_AUTH_TOKEN')
+    if os.getenv('GITHUB_APP_ID'):
+        try:
+            github.Github(get_github_app_token()).get_rate_limit()
+        except (AssertionError, OSError, github.GithubException) as exp:
+            errors.append(f'GitHub App authentication failed: {exp}')
+    elif not github_auth_token:
+        errors.append('GITHUB_AUTH_TOKEN is not set')
+    else:
+        for index, token in enumerate(github_auth_token.split(','), 1):
+            try:
+                github.Github(token).get_rate_limit()
+            except github.GithubException as exp:
+                errors.append(f'GitHub token #{index} failed: {exp}')
+    gitlab_auth_token = os.getenv('GITLAB_AUTH_TOKEN')
+    if gitlab_auth_token:
+        try:
+            gitlab.Gitlab(gitlab_host, gitlab_auth_token).auth()
+        except gitlab.exceptions.GitlabAuthenticationError as exp:
+            errors.append(f'GitLab token failed for {gitlab_host}: {exp}')
+    if errors:
+        raise Exception('Auth tokens are misconfigured:\n' + '\n'.join(errors))
+
+
 def get_gitlab_auth_token(host):
     """Return a gitlab token object."""
     gitlab_auth_token = os.getenv('GITLAB_AUTH_TOKEN')
@@ -569,41 +1817,379 @@ def get_gitlab_auth_token(host):
     return token_obj
 
 
-def get_repository(url):
-    """Return repository object, given a url."""
+def normalize_repo_url(url):
+    """Return the canonical url of the repository root, dropping www., .git
+    suffixes, trailing slashes and subpaths like /tree/main. github.com and
+    gitlab.com urls always use https, while self-hosted GitLab keeps the
+    given scheme, since it may only be served over http."""
     if not '://' in url:
         url = 'https://' + url
 
+    parsed_url = urllib.parse.urlparse(url)
+    netloc = parsed_url.netloc.lower()
+    if netloc.startswith('www.'):
+        netloc = netloc[len('www.'):]
+    path = parsed_url.path.strip('/')
+    # GitLab puts repository subpaths after a /-/ separator.
+    path = path.split('/-/')[0]
+    if netloc == 'github.com':
+        # GitHub repositories are always <owner>/<name>, anything after is a
+        # page of the repository.
+        path = '/'.join(path.split('/')[:2])
+    if path.endswith('.git'):
+        path = path[:-len('.git')]
+    scheme = parsed_url.scheme.lower()
+    if netloc in ('github.com', 'gitlab.com'):
+        scheme = 'https'
+    return f'{scheme}://{netloc}/{path}'
+
+
+def resolve_package_repo_url(package):
+    """Return the source repository url of a package given in form
+    <system>/<name> (e.g. npm/lodash, pypi/requests), or None if unknown."""
+    system, _, name = package.partition('/')
+    if not system or not name:
+        logger.error(f'Package in bad format: {package}')
+        return None
+    package_url = (f'{DEPS_DEV_API_URL}/systems/{system.lower()}/packages/'
+                   f'{urllib.parse.quote_plus(name)}')
+    result = requests.get(package_url)
+    if result.status_code != 200:
+        return None
+    versions = json.loads(result.content).get('versions', [])
+    default_version = next((v for v in versions if v.get('isDefault')), None)
+    if not default_version:
+        return None
+    version = urllib.parse.quote_plus(
+        default_version['versionKey']['version'])
+    result = requests.get(f'{package_url}/versions/{version}')
+    if result.status_code != 200:
+        return None
+    for project in json.loads(result.content).get('relatedProjects', []):
+        if project.get('relationType') == 'SOURCE_REPO':
+            return project['projectKey']['id']
+    return None
+
+
+def split_repo_path(url):
+    """Split the path of a repository url into the owner, the possibly nested
+    path up to the repository, and the repository name."""
+    owner, _, repo_name = urllib.parse.urlparse(url).path.strip('/').rpartition(
+        '/')
+    return owner, repo_name
+
+
+def split_repo_ref(url):
+    """Split a url in form <repo url>@<ref> into the url and the ref, which is
+    None if not given."""
+    path_start = url.find('/', url.find('://') + 3 if '://' in url else 0)
+    if path_start < 0 or '@' not in url[path_start:]:
+        return url, None
+    ref_start = url.index('@', path_start)
+    return url[:ref_start], url[ref_start + 1:] or None
+
+
+def get_url_review_reason(url):
+    """Return why url cannot be collected as a repository, e.g. it is an org,
+    user or gist page or on an unsupported host, or None if it looks like a
+    repository. Does not make any request."""
+    url, _ = split_repo_ref(url)
+    parsed_url = urllib.parse.urlparse(normalize_repo_url(url))
+    path_parts = [part for part in parsed_url.path.split('/') if part]
+    if parsed_url.netloc == 'gist.github.com':
+        return 'gist, not a repository'
+    if parsed_url.netloc.endswith('github.com'):
+        if len(path_parts) != 2:
+            return 'not a repository, e.g. an org or user page'
+        return None
+    if 'gitlab' in parsed_url.netloc:
+        if len(path_parts) < 2:
+            return 'not a repository, e.g. a group or user page'
+        return None
+    return 'unsupported host'
+
+
+def open_review_file(filename):
+    """Return a file handle and csv writer to record inputs that do not
+    resolve to a collectable repository, with the reason."""
+    file_handle = open(filename, 'w')
+    csv_writer = csv.writer(file_handle)
+    csv_writer.writerow(['input', 'reason'])
+    return file_handle, csv_writer
+
+
+def get_repository(url, github_client=None):
+    """Return repository object, given a url.
+
+    The url can end with @<ref> to read file based params at that branch, tag
+    or commit instead of the default branch. None is returned if the
+    repository or the ref is not found. If github_client is provided, it
+    and its token are used for GitHub repositories instead of the ones from
+    GITHUB_AUTH_TOKEN."""
+    url, ref = split_repo_ref(url)
+    url = normalize_repo_url(url)
+    # Catch org, user and gist urls before spending an api request.
+    review_reason = get_url_review_reason(url)
+    if review_reason:
+        logger.error(f'Url is not a repository ({review_reason}): {url}')
+        return None
+
     parsed_url = urllib.parse.urlparse(url)
     repo_url = parsed_url.path.strip('/')
     if parsed_url.netloc.endswith('github.com'):
         repo = None
+        github_token = None
+        if github_client:
+            github_token = get_github_client_token(github_client)
+            if not github_token:
+                logger.warning('Could not read the token of github_client, '
+                               'falling back to GITHUB_AUTH_TOKEN for '
+                               'requests made outside of it.')
         try:
-            repo = get_github_auth_token().get_repo(repo_url)
+            token_obj = github_client or get_github_auth_token()
+            repo = token_obj.get_repo(repo_url)
         except github.GithubException as exp:
             if exp.status == 404:
                 return None
-        return GitHubRepository(repo)
+        if repo and ref:
+            # Files at a missing ref would read as absent, e.g. has_ci False.
+            try:
+                repo.get_commit(ref)
+            except github.GithubException as exp:
+                if exp.status in (404, 422):
+                    logger.error(f'Ref is not found: {url}@{ref}')
+                    return None
+                raise
+        # GitHub transparently redirects renamed or transferred repositories.
+        redirected_from = None
+        if repo and repo.full_name.lower() != repo_url.lower():
+            redirected_from = url
+            logger.warning(f'Repo has moved: {url} -> {repo.html_url}')
+        return GitHubRepository(repo, redirected_from, ref, github_token)
     if 'gitlab' in parsed_url.netloc:
         repo = None
         host = parsed_url.scheme + '://' + parsed_url.netloc
         token_obj = get_gitlab_auth_token(host)
         repo_url_encoded = urllib.parse.quote_plus(repo_url)
         try:
-            repo = token_obj.projects.get(repo_url_encoded)
+            repo = token_obj.projects.get(repo_url_encoded, statistics=True)
         except gitlab.exceptions.GitlabGetError as exp:
             if exp.response_code == 404:
                 return None
-        return GitLabRepository(repo)
+        if repo and ref:
+            try:
+                repo.commits.get(ref)
+            except gitlab.exceptions.GitlabGetError as exp:
+                if exp.response_code == 404:
+                    logger.error(f'Ref is not found: {url}@{ref}')
+                    return None
+                raise
+        redirected_from = None
+        if repo and repo.path_with_namespace.lower() != repo_url.lower():
+            redirected_from = url
+            logger.warning(f'Repo has moved: {url} -> {repo.web_url}')
+        return GitLabRepository(repo, redirected_from, ref)
+
+
+def _convert_config_item(action, value):
+    """Return a single config value converted like argparse converts the
+    command line value of action, or raise ValueError if it is invalid."""
+    type_func = action.type or str
+    if value is None or isinstance(value, (bool, dict, list)):
+        raise ValueError(f'must be of type {type_func.__name__}')
+    if type_func is str:
+        if not isinstance(value, str):
+            raise ValueError('must be of type str')
+    else:
+        try:
+            # Same as on the command line, e.g. 1.5 is not a valid int.
+            value = type_func(str(value))
+        except (TypeError, ValueError, argparse.ArgumentTypeError):
+            raise ValueError(f'must be of type {type_func.__name__}') from None
+    if action.choices is not None and value not in action.choices:
+        raise ValueError(f'must be one of {list(action.choices)}')
+    return value
+
+
+def _convert_config_value(action, value):
+    """Return a config value converted like argparse converts the command
+    line value of action, or raise ValueError if it is invalid."""
+    if isinstance(action,
+                  (argparse._StoreTrueAction, argparse._StoreFalseAction)):
+        if not isinstance(value, bool):
+            raise ValueError('must be true or false')
+        return value
+    if action.nargs == 0:
+        # E.g. --help and --list-params, which act rather than store a value.
+        raise ValueError('cannot be set in a config file')
+    if action.nargs in ('+', '*'):
+        if not isinstance(value, list):
+            raise ValueError('must be a list')
+        return [_convert_config_item(action, item) for item in value]
+    return _convert_config_item(action, value)
+
+
+def parse_args_with_config(parser):
+    """Parse args, taking defaults from a json --config file if given.
+
+    Flags given on the command line override values from the config file."""
+    parser.add_argument('--config',
+                        type=str,
+                        help='Json file with values for any of the flags.')
+    config_parser = argparse.ArgumentParser(add_help=False)
+    config_parser.add_argument('--config', type=str)
+    args, _ = config_parser.parse_known_args()
+    if args.config:
+        with open(args.config) as file_handle:
+            try:
+                config = json.load(file_handle)
+            except json.JSONDecodeError as exp:
+                parser.error(f'Malformed config {args.config} at line '
+                             f'{exp.lineno} column {exp.colno}: {exp.msg}')
+        if not isinstance(config, dict):
+            parser.error(f'Config {args.config} must be a json object of '
+                         'flag names to values.')
+        config = {key.replace('-', '_'): value for key, value in config.items()}
+        known_keys = {action.dest for action in parser._actions}
+        unknown_keys = set(config) - known_keys
+        if unknown_keys:
+            parser.error(
+                f'Unknown keys in config {args.config}: {sorted(unknown_keys)}')
+        for action in parser._actions:
+            if action.dest in config:
+                action.required = False
+                try:
+                    config[action.dest] = _convert_config_value(
+                        action, config[action.dest])
+                except ValueError as exp:
+                    parser.error(f'Config {args.config} key {action.dest} '
+                                 f'{exp}.')
+        for group in parser._mutually_exclusive_groups:
+            if any(action.dest in config for action in group._group_actions):
+                group.required = False
+        parser.set_defaults(**config)
+    return parser.parse_args()
+
+
+def get_param_descriptions():
+    """Yield (param, value type, scoring, description) for every param, where
+    scoring gives the weight and max threshold of scored params and marks the
+    extra params. Every param can also be None where noted in its
+    description."""
+    for param in PARAMS + EXTRA_PARAMS:
+        if param in SCORED_PARAMS:
+            weight, max_threshold = SCORED_PARAMS[param]
+            scoring = f'weight={weight} max_threshold={max_threshold}'
+        elif param in EXTRA_PARAMS:
+            scoring = 'unscored, only with --extra-params'
+        else:
+            scoring = 'unscored'
+        yield (param, get_param_type(param).__name__, scoring,
+               get_param_description(param))
+
+
+def get_param_type(param):
+    """Return the type of the param values, from the return annotation of
+    its property."""
+    return getattr(Repository, param).fget.__annotations__['return']
+
+
+def get_param_description(param):
+    """Return the description of a param, from the docstring of its
+    property."""
+    return ' '.join(getattr(Repository, param).__doc__.split())
+
+
+_JSON_SCHEMA_TYPES = {
+    bool: 'boolean',
+    float: 'number',
+    int: 'integer',
+    str: 'string',
+}
+
+# Descriptions of the string columns added after the params and score.
+_EXTRA_COLUMN_DESCRIPTIONS = {
+    'run_id': 'Id of the run that collected the row.',
+    'scoring_hash': 'Fingerprint of the scoring definition the score was '
+                    'computed with.',
+    'status': 'ok, or uncollectable for a placeholder row without stats.',
+}
+
+
+def get_output_schema(params,
+                      param_status=False,
+                      normalized=False,
+                      extra_columns=(),
+                      nullable=False):
+    """Return a JSON schema of the result rows with params, derived from the
+    param properties like get_param_descriptions.
+
+    param_status and normalized add the status and normalized columns.
+    extra_columns are the names of string columns added after those, e.g.
+    scoring_hash. nullable makes every column nullable, for placeholder
+    rows."""
+    columns = {
+        'name': (str, 'Name of the repository.', False),
+        'url': (str, 'Url of the repository.', False),
+        'language': (str, 'Primary language of the repository.', True),
+    }
+    for param in params:
+        # Unscored params are left empty if they cannot be collected.
+        columns[param] = (get_param_type(param), get_param_description(param),
+                          param not in SCORED_PARAMS)
+    columns['criticality_score'] = (
+        float, 'Criticality score between 0 (least critical) and 1 (most '
+        'critical).', False)
+    if param_status:
+        for param in params:
+            if param not in SCORED_PARAMS:
+                columns[f'{param}_status'] = (
+                    str, f'Whether {param} was collected: ok, error or '
+                    'timeout.', False)
+    if normalized:
+        for param in SCORED_PARAMS:
+            columns[f'{param}_normalized'] = (
+                float, f'{param} normalized to [0, 1], before weighting.',
+                False)
+    for column in extra_columns:
+        columns[column] = (str,
+                           _EXTRA_COLUMN_DESCRIPTIONS.get(
+                               column, 'Extra column.'), False)
+    properties = {}
+    for column, (value_type, description, nullable_column) in columns.items():
+        json_type = _JSON_SCHEMA_TYPES[value_type]
+        properties[column] = {
+            'type': ([json_type, 'null'] if nullable or nullable_column else
+                     json_type),
+            'description': description,
+        }
+    return {
+        '$schema': JSON_SCHEMA_URL,
+        'title': 'criticality_score result',
+        'type': 'object',
+        'properties': properties,
+        'required': list(properties),
+    }
+
 
-    raise Exception('Unsupported url!')
+class ListParamsAction(argparse.Action):
+    """Print every param and exit, like --help."""
+    def __init__(self, option_strings, dest, **kwargs):
+        super().__init__(option_strings, dest, nargs=0, **kwargs)
+
+    def __call__(self, parser, namespace, values, option_string=None):
+        for param, value_type, scoring, description in (
+                get_param_descriptions()):
+            print(f'{param}\t{value_type}\t{scoring}\t{description}')
+        parser.exit()
 
 
 def initialize_logging_handlers():
     logging.basicConfig(level=logging.INFO)
     logging.getLogger('').handlers.clear()
 
-    console = logging.StreamHandler()
+    # Keep stdout for the results, so they can be piped without log lines.
+    console = logging.StreamHandler(sys.stderr)
     console.setLevel(logging.INFO)
     logging.getLogger('').addHandler(console)
 
@@ -611,10 +2197,18 @@ def initialize_logging_handlers():
 def main():
     parser = argparse.ArgumentParser(
         description='Gives criticality score for an open source project')
-    parser.add_argument("--repo",
-                        type=str,
-                        required=True,
-                        help="repository url")
+    target_group = parser.add_mutually_exclusive_group(required=True)
+    target_group.add_argument("--repo", type=str, help="repository url")
+    target_group.add_argument(
+        "--package",
+        type=str,
+        help="package in form <system>/<name> (e.g. npm/lodash), whose "
+        "source repository is looked up on deps.dev")
+    target_group.add_argument(
+        "--print-schema",
+        action='store_true',
+        help="print a JSON schema of the output columns for the other flags, "
+        "e.g. --extra-params, and exit")
     parser.add_argument(
         "--format",
         type=str,
@@ -627,26 +2221,108 @@ def main():
         default=[],
         help='Additional parameters in form <value>:<weight>:<max_threshold>',
         required=False)
+    parser.add_argument(
+        '--timeout',
+        type=int,
+        help='Give up on the repository if computing its scored params takes '
+        'longer than this many seconds. Unscored params still running are '
+        'left empty.')
+    parser.add_argument(
+        '--score-precision',
+        type=int,
+        default=SCORE_PRECISION,
+        help='Number of decimal places in the criticality score.')
+    parser.add_argument(
+        '--normalized',
+        action='store_true',
+        help='Also output the normalized [0, 1] value of each scored param.')
+    parser.add_argument(
+        '--list-params',
+        action=ListParamsAction,
+        help='List every param with its scoring weight and threshold, and '
+        'exit.')
+    parser.add_argument(
+        '--null-value',
+        type=str,
+        default='',
+        help='Value written to csv for unset params, e.g. NULL or \\N. '
+        'Defaults to an empty string.')
+    parser.add_argument(
+        '--param-status',
+        action='store_true',
+        help='Also output a <param>_status column for each unscored param: '
+        'ok, or error or timeout if it was left empty because collecting it '
+        'failed.')
+    parser.add_argument(
+        '--scoring-hash-column',
+        action='store_true',
+        help='Also output a scoring_hash fingerprint of the weights, '
+        'thresholds, --params and activity filter the score was computed '
+        'with.')
+    parser.add_argument(
+        '--review-out',
+        type=str,
+        help='Csv file to record the repo, with the reason, if it is not a '
+        'collectable repository, e.g. an org page or unsupported host.')
+    add_activity_filter_arguments(parser)
+    add_extra_params_argument(parser)
 
     initialize_logging_handlers()
 
-    args = parser.parse_args()
+    args = parse_args_with_config(parser)
+    set_activity_filter_from_args(args)
+    set_extra_params_from_args(args)
+    if args.print_schema:
+        schema = get_output_schema(
+            get_enabled_params(), args.param_status, args.normalized,
+            ['scoring_hash'] if args.scoring_hash_column else [])
+        print(json.dumps(schema, indent=4))
+        return
+    review_item = None
+    review_reason = None
+    if args.package:
+        args.repo = resolve_package_repo_url(args.package)
+        if not args.repo:
+            logger.error(f'Source repo is not found: {args.package}')
+            review_item = args.package
+            review_reason = PACKAGE_NOT_RESOLVED_REASON
+        else:
+            logger.info(f'Resolved {args.package} to {args.repo}')
+    if not review_reason:
+        review_item = args.repo
+        review_reason = get_url_review_reason(args.repo)
+        if review_reason:
+            logger.error(
+                f'Url is not a repository ({review_reason}): {args.repo}')
+    if review_reason:
+        if args.review_out:
+            file_handle, csv_writer = open_review_file(args.review_out)
+            with file_handle:
+                csv_writer.writerow([review_item, review_reason])
+        return
     repo = get_repository(args.repo)
     if not repo:
         logger.error(f'Repo is not found: {args.repo}')
         return
-    output = get_repository_stats(repo, args.params)
+    output = get_repository_stats(repo, args.params, args.timeout,
+                                  args.score_precision, args.param_status)
     if not output:
         return
+    if args.normalized:
+        output.update(get_normalized_param_values(output))
+    if args.scoring_hash_column:
+        output['scoring_hash'] = get_scoring_hash(
+            args.params, score_precision=args.score_precision)
     if args.format == 'default':
         for key, value in output.items():
-            logger.info(f'{key}: {value}')
+            print(f'{key}: {value}')
     elif args.format == 'json':
-        logger.info(json.dumps(output, indent=4))
+        print(json.dumps(output, indent=4))
     elif args.format == 'csv':
         csv_writer = csv.writer(sys.stdout)
         csv_writer.writerow(output.keys())
-        csv_writer.writerow(output.values())
+        csv_writer.writerow(args.null_value if value is None else value
+                            for value in output.values())
     else:
         raise Exception(
             'Wrong format argument, use one of default, csv or json!')
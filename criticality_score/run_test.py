@@ -0,0 +1,350 @@
+# Copyright 2020 Google LLC
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""Tests for run.py."""
+
+import contextlib
+import csv
+import datetime
+import io
+import logging
+import sys
+import unittest
+import urllib.parse
+from unittest import mock
+
+import github
+import requests
+
+from . import run
+
+
+class NormalizeRepoUrlTest(unittest.TestCase):
+    """Tests for normalize_repo_url."""
+    def test_normalize_repo_url(self):
+        test_cases = [
+            ('github.com/owner/repo', 'https://github.com/owner/repo'),
+            ('http://github.com/owner/repo', 'https://github.com/owner/repo'),
+            ('https://www.github.com/owner/repo',
+             'https://github.com/owner/repo'),
+            ('https://GitHub.com/owner/repo', 'https://github.com/owner/repo'),
+            ('https://github.com/owner/repo/', 'https://github.com/owner/repo'),
+            ('https://github.com/owner/repo.git',
+             'https://github.com/owner/repo'),
+            ('https://github.com/owner/repo/tree/main/src',
+             'https://github.com/owner/repo'),
+            ('https://github.com/owner/repo/commit/abc123',
+             'https://github.com/owner/repo'),
+            ('https://github.com/owner/repo/security/advisories',
+             'https://github.com/owner/repo'),
+            ('https://github.com/owner/repo/discussions/1',
+             'https://github.com/owner/repo'),
+            ('https://github.com/owner', 'https://github.com/owner'),
+            ('https://gitlab.com/group/subgroup/repo',
+             'https://gitlab.com/group/subgroup/repo'),
+            ('https://gitlab.com/group/repo/-/tree/main',
+             'https://gitlab.com/group/repo'),
+            ('https://gitlab.com/group/repo.git',
+             'https://gitlab.com/group/repo'),
+            ('http://gitlab.com/group/repo', 'https://gitlab.com/group/repo'),
+            ('http://gitlab.example.com/group/repo',
+             'http://gitlab.example.com/group/repo'),
+            ('HTTP://gitlab.example.com/group/repo/-/tree/main',
+             'http://gitlab.example.com/group/repo'),
+            ('gitlab.example.com/group/repo',
+             'https://gitlab.example.com/group/repo'),
+        ]
+        for url, expected in test_cases:
+            with self.subTest(url=url):
+                self.assertEqual(run.normalize_repo_url(url), expected)
+
+
+class CommitFrequencyTest(unittest.TestCase):
+    """Tests for GitHubRepository.commit_frequency."""
+    def test_retry_after_stats_are_computed(self):
+        weekly_stats = [mock.Mock(total=2)] * 52
+        github_repo = mock.Mock()
+        # GitHub answers 202 (None) until the stats are computed.
+        github_repo.get_stats_commit_activity.side_effect = (
+            [None] * run.FAIL_RETRIES + [weekly_stats])
+        repo = run.GitHubRepository(github_repo)
+        with mock.patch.object(run.time, 'sleep'):
+            with self.assertRaises(run.CollectionError) as context:
+                _ = repo.commit_frequency
+            self.assertTrue(context.exception.retryable)
+            self.assertEqual(repo.commit_frequency, 2.0)
+        self.assertEqual(github_repo.get_stats_commit_activity.call_count,
+                         run.FAIL_RETRIES + 1)
+
+
+def _get_abuse_error():
+    """Return a stubbed 403 secondary (abuse) rate limit response."""
+    return github.GithubException(
+        403, {
+            'message': 'You have exceeded a secondary rate limit. Please '
+                       'wait a few minutes before you try again.'
+        }, {'retry-after': '60'})
+
+
+class IsGithubSecondaryRateLimitErrorTest(unittest.TestCase):
+    """Tests for is_github_secondary_rate_limit_error."""
+    def test_is_github_secondary_rate_limit_error(self):
+        test_cases = [
+            (_get_abuse_error(), True),
+            (github.GithubException(
+                403, {'message': 'You have triggered an abuse detection '
+                                 'mechanism.'}, {}), True),
+            (github.GithubException(
+                403, {'message': 'API rate limit exceeded for user ID 1.'},
+                {'x-ratelimit-remaining': '0'}), False),
+            (github.GithubException(
+                403, {'message': 'Resource not accessible by integration'},
+                {}), False),
+            (github.GithubException(403, None, {}), False),
+            (github.GithubException(502, {'message': 'abuse'}, {}), False),
+        ]
+        for exp, expected in test_cases:
+            with self.subTest(exp=exp):
+                self.assertEqual(run.is_github_secondary_rate_limit_error(exp),
+                                 expected)
+
+
+class IsRetryableErrorTest(unittest.TestCase):
+    """Tests for is_retryable_error."""
+    def test_is_retryable_error(self):
+        rate_limit_data = {'message': 'API rate limit exceeded for user ID 1.'}
+        test_cases = [
+            (github.GithubException(500, {'message': 'Server Error'}, {}),
+             True),
+            (github.RateLimitExceededException(
+                403, rate_limit_data, {'x-ratelimit-remaining': '0'}), True),
+            (_get_abuse_error(), True),
+            (github.GithubException(403, rate_limit_data,
+                                    {'x-ratelimit-remaining': '0'}), True),
+            (github.GithubException(
+                403, {'message': 'Resource not accessible by integration'},
+                {'x-ratelimit-remaining': '4999'}), False),
+            (github.GithubException(404, {'message': 'Not Found'}, {}),
+             False),
+            (run.CollectionError('Stats are not ready', retryable=True), True),
+            (run.CollectionError('Search failed'), False),
+            (requests.exceptions.Timeout(), True),
+            (ValueError('Bad value'), False),
+        ]
+        for exp, expected in test_cases:
+            with self.subTest(exp=exp):
+                self.assertEqual(run.is_retryable_error(exp), expected)
+
+
+class GetRepositoryStatsTest(unittest.TestCase):
+    """Tests for retries in get_repository_stats."""
+    def _get_failure(self, exp):
+        """Return (attempts, retryable) of a param that always raises exp."""
+        attempts = []
+
+        class FailingRepository:
+            url = 'https://github.com/owner/repo'
+            last_commit = 'abc123'
+
+            @property
+            def commit_frequency(self):
+                attempts.append(exp)
+                raise exp
+
+        with mock.patch.object(run, 'PARAMS', ['commit_frequency']):
+            with mock.patch.object(run.time, 'sleep') as self.sleep:
+                with self.assertRaises(run.CollectionError) as context:
+                    with mock.patch.object(run.logger, 'warning'):
+                        run.get_repository_stats(FailingRepository())
+        return len(attempts), context.exception.retryable
+
+    def test_rate_limit_is_retried(self):
+        exp = github.RateLimitExceededException(
+            403, {'message': 'API rate limit exceeded'},
+            {'x-ratelimit-remaining': '0'})
+        self.assertEqual(self._get_failure(exp), (run.PARAM_RETRIES, True))
+
+    def test_secondary_rate_limit_waits_before_retry(self):
+        self.assertEqual(self._get_failure(_get_abuse_error()),
+                         (run.PARAM_RETRIES, True))
+        self.sleep.assert_called_with(run.SECONDARY_RATE_LIMIT_WAIT_SECONDS)
+
+    def test_server_error_is_retried(self):
+        exp = github.GithubException(502, {'message': 'Bad Gateway'}, {})
+        self.assertEqual(self._get_failure(exp), (run.PARAM_RETRIES, True))
+
+    def test_missing_resource_is_not_retried(self):
+        exp = github.GithubException(404, {'message': 'Not Found'}, {})
+        self.assertEqual(self._get_failure(exp), (1, False))
+
+    def test_unscored_failure_is_left_empty(self):
+        class PartialRepository:
+            url = 'https://github.com/owner/repo'
+            name = 'repo'
+            language = 'c'
+            last_commit = 'abc123'
+
+            def __getattr__(self, param):
+                if param == 'license':
+                    raise run.CollectionError('Server error', retryable=True)
+                return 1
+
+        with mock.patch.object(run, 'PARAMS',
+                               list(run.SCORED_PARAMS) + ['license']):
+            with mock.patch.object(run.time, 'sleep'):
+                with mock.patch.object(run.logger, 'warning'):
+                    stats = run.get_repository_stats(PartialRepository(),
+                                                     param_status=True)
+        self.assertIsNone(stats['license'])
+        self.assertEqual(stats['license_status'], 'error')
+        self.assertNotIn('commit_frequency_status', stats)
+        self.assertEqual(stats['criticality_score'],
+                         run.get_criticality_score(stats))
+
+
+class GetOutputSchemaTest(unittest.TestCase):
+    """Tests for get_output_schema."""
+    def test_every_param_has_a_type(self):
+        params = run.PARAMS + run.EXTRA_PARAMS
+        schema = run.get_output_schema(params, param_status=True)
+        self.assertEqual(schema['required'][:len(params) + 3],
+                         ['name', 'url', 'language'] + params)
+        self.assertEqual(schema['properties']['criticality_score']['type'],
+                         'number')
+        self.assertEqual(schema['properties']['commit_frequency']['type'],
+                         'number')
+        self.assertEqual(schema['properties']['has_ci']['type'],
+                         ['boolean', 'null'])
+        self.assertEqual(schema['properties']['has_ci_status']['type'],
+                         'string')
+        self.assertNotIn('commit_frequency_status', schema['properties'])
+
+
+class ActivityFilterTest(unittest.TestCase):
+    """Tests for the issue label and window filters of the activity params."""
+    since_time = datetime.datetime(2021, 3, 1)
+
+    def setUp(self):
+        patcher = mock.patch.object(run.logger, 'warning')
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.addCleanup(run.set_activity_filter)
+
+    def test_issue_lookback_days_overrides_window(self):
+        now = datetime.datetime.utcnow()
+        run.set_activity_filter(window_days=30)
+        self.assertAlmostEqual(
+            (now - run.Repository._get_issues_since_time()).days, 30, delta=1)
+        run.set_activity_filter(issue_lookback_days=7, window_days=30)
+        self.assertAlmostEqual(
+            (now - run.Repository._get_issues_since_time()).days, 7, delta=1)
+
+    def test_github_labeled_issue_search_query(self):
+        run.set_activity_filter(include_labels=['bug', 'good first issue'],
+                                exclude_labels=['wontfix'])
+        repo = run.GitHubRepository(mock.Mock(full_name='owner/repo'))
+        response = mock.Mock(status_code=200, content=b'{"total_count": 7}')
+        with mock.patch.object(run.Repository,
+                               '_get_issues_since_time',
+                               return_value=self.since_time):
+            with mock.patch.object(run.Repository,
+                                   '_request_url_with_retries',
+                                   return_value=response) as request:
+                self.assertEqual(repo.closed_issues_count, 7)
+        query = urllib.parse.parse_qs(
+            urllib.parse.urlparse(request.call_args[0][0]).query)['q'][0]
+        self.assertEqual(
+            query, 'repo:owner/repo updated:>=2021-03-01 is:closed '
+            'label:"bug" label:"good first issue" -label:"wontfix"')
+
+    def test_github_without_labels_does_not_search(self):
+        github_repo = mock.Mock()
+        github_repo.get_issues.return_value.totalCount = 3
+        repo = run.GitHubRepository(github_repo)
+        with mock.patch.object(run.Repository,
+                               '_request_url_with_retries') as request:
+            self.assertEqual(repo.updated_issues_count, 3)
+        request.assert_not_called()
+
+    def test_gitlab_issue_filter_kwargs(self):
+        run.set_activity_filter(include_labels=['bug', 'p1'],
+                                exclude_labels=['wontfix', 'duplicate'])
+        gitlab_repo = mock.Mock()
+        gitlab_repo.issuesstatistics.get.return_value.statistics = {
+            'counts': {
+                'all': 5,
+                'closed': 2
+            }
+        }
+        repo = run.GitLabRepository(gitlab_repo)
+        with mock.patch.object(run.Repository,
+                               '_get_issues_since_time',
+                               return_value=self.since_time):
+            self.assertEqual(repo.updated_issues_count, 5)
+        gitlab_repo.issuesstatistics.get.assert_called_once_with(
+            updated_after=self.since_time,
+            labels='bug,p1',
+            **{'not[labels]': 'wontfix,duplicate'})
+
+    def test_gitlab_issue_filter_kwargs_without_labels(self):
+        repo = run.GitLabRepository(mock.Mock())
+        with mock.patch.object(run.Repository,
+                               '_get_issues_since_time',
+                               return_value=self.since_time):
+            self.assertEqual(repo._get_issue_filter_kwargs(),
+                             {'updated_after': self.since_time})
+
+
+class MainOutputTest(unittest.TestCase):
+    """Tests for the output of main."""
+    def setUp(self):
+        root_logger = logging.getLogger()
+        handlers = list(root_logger.handlers)
+        level = root_logger.level
+
+        def _restore_logging():
+            root_logger.handlers[:] = handlers
+            root_logger.setLevel(level)
+
+        self.addCleanup(_restore_logging)
+
+    def test_csv_stdout_has_no_log_lines(self):
+        stats = {'name': 'repo', 'url': 'https://github.com/owner/repo'}
+
+        def _get_repository_stats(*_):
+            run.logger.info('Collecting stats.')
+            run.logger.warning('Retrying after error.')
+            return dict(stats)
+
+        stdout = io.StringIO()
+        stderr = io.StringIO()
+        argv = [
+            'criticality_score', '--repo', 'github.com/owner/repo',
+            '--format', 'csv'
+        ]
+        with mock.patch.object(sys, 'argv', argv):
+            with mock.patch.object(run, 'get_repository'):
+                with mock.patch.object(run,
+                                       'get_repository_stats',
+                                       side_effect=_get_repository_stats):
+                    with contextlib.redirect_stdout(stdout):
+                        with contextlib.redirect_stderr(stderr):
+                            run.main()
+        self.assertEqual(list(csv.reader(io.StringIO(stdout.getvalue()))),
+                         [list(stats), list(stats.values())])
+        self.assertIn('Collecting stats.', stderr.getvalue())
+        self.assertIn('Retrying after error.', stderr.getvalue())
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -36,6 +36,9 @@ setuptools.setup(
         'PyGithub>=1.53',
         'python-gitlab>=2.5.0',
     ],
+    extras_require={
+        'socks': ['requests[socks]'],
+    },
     entry_points={
         'console_scripts': ['criticality_score=criticality_score.run:main'],
     },